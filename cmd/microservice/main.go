@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
 	"runtime/debug"
+	"strings"
 	"syscall"
 	"time"
 
@@ -22,8 +25,10 @@ import (
 	"github.com/kjushka/microservice-gen/internal/logger"
 	"github.com/kjushka/microservice-gen/internal/migrator"
 	"github.com/kjushka/microservice-gen/internal/ratelimiter"
+	"github.com/kjushka/microservice-gen/internal/storage"
 	"github.com/kjushka/microservice-gen/internal/storage/cache"
 	"github.com/kjushka/microservice-gen/internal/storage/database"
+	"github.com/kjushka/microservice-gen/internal/storage/sharding"
 	"github.com/kjushka/microservice-gen/internal/storage/storage-with-cache"
 	"github.com/kjushka/microservice-gen/internal/tracing"
 	microservicepb2 "github.com/kjushka/microservice-gen/pkg/microservice"
@@ -38,11 +43,18 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
 
-const serviceName = "some service"
+const (
+	serviceName = "some service"
+	// callerHeader identifies client for read-your-writes, it's optional
+	callerHeader = "x-caller-id"
+)
 
 // interceptorLogger adapts go-kit logger to interceptor logger.
 // This code is simple enough to be copied and not imported.
@@ -64,10 +76,154 @@ func interceptorLogger() logging.Logger {
 	})
 }
 
+// initBackend connects configured source of truth, registers its metrics and starts its background jobs.
+// Watcher is nil if watch is disabled, sharded backend doesn't support it
+func initBackend(
+	ctx context.Context,
+	cfg *config.Config,
+	tracer trace.Tracer,
+	reg prometheus.Registerer,
+) (storage_with_cache.Backend, storage.Watcher) {
+	mg := migrator.InitMigrator(cfg)
+	switch cfg.StorageBackend {
+	case "postgres":
+		db, err := database.InitDB(ctx, cfg, tracer)
+		if err != nil {
+			logger.PanicKV(ctx, "failed create database conn", "error", err)
+		}
+
+		if cfg.DBMigrateOnStart {
+			err = mg.Migrate(ctx, db.GetDB())
+			if err != nil {
+				logger.PanicKV(ctx, "failed migrate process", "error", err)
+			}
+		}
+		err = mg.CheckClean(ctx, db.GetDB())
+		if err != nil {
+			logger.PanicKV(ctx, "database isn't ready", "error", err)
+		}
+		go db.RunSweeper(logger.WithName(ctx, "sweeper"))
+		go db.RunReplicaMonitor(logger.WithName(ctx, "replicas"))
+		if !cfg.StorageWatch {
+			return db, nil
+		}
+		return db, db
+	case "sharded":
+		db, err := sharding.InitDB(ctx, cfg, tracer)
+		if err != nil {
+			logger.PanicKV(ctx, "failed create sharded database conn", "error", err)
+		}
+
+		var report migrator.ShardsReport
+		if cfg.DBMigrateOnStart {
+			report, err = mg.MigrateShards(ctx, cfg.DBShardServers, db.ShardSchemas())
+		} else {
+			report, err = mg.ShardsStatus(ctx, cfg.DBShardServers, db.ShardSchemas())
+		}
+		for _, shard := range report.Behind() {
+			logger.WarnKV(ctx, "shard schema is behind migrations",
+				"server", shard.Server, "schema", shard.Schema, "version", shard.Version,
+				"dirty", shard.Dirty, "latest", report.Latest)
+		}
+		if err != nil {
+			logger.PanicKV(ctx, "failed migrate shards", "error", err)
+		}
+		err = report.CheckClean()
+		if err != nil {
+			logger.PanicKV(ctx, "database isn't ready", "error", err)
+		}
+		err = db.CheckSchemas(ctx)
+		if err != nil {
+			logger.PanicKV(ctx, "failed check shard schemas", "error", err)
+		}
+		registerReshardingMetrics(reg, db)
+
+		go db.RunResharding(logger.WithName(ctx, "resharding"))
+		go db.RunSweeper(logger.WithName(ctx, "sweeper"))
+		return db, nil
+	default:
+		logger.PanicKV(ctx, "unknown storage backend", "backend", cfg.StorageBackend)
+		return nil, nil
+	}
+}
+
+// reencrypter is implemented by backends which rewrite records encrypted by old keys of keyfile
+type reencrypter interface {
+	RunReencrypt(ctx context.Context, invalidator storage.Invalidator)
+}
+
+// callerInterceptor marks request with caller for read-your-writes of database. Caller is x-caller-id
+// metadata, then client address forwarded by http gateway, then peer address of connection.
+// Pins are kept by instance which served write, caller moved to other instance may read lagging replica
+func callerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		for _, header := range []string{callerHeader, "x-forwarded-for"} {
+			if values := metadata.ValueFromIncomingContext(ctx, header); len(values) > 0 && values[0] != "" {
+				return handler(database.WithCaller(ctx, values[0]), req)
+			}
+		}
+		if p, ok := peer.FromContext(ctx); ok {
+			return handler(database.WithCaller(ctx, p.Addr.String()), req)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// gatewayHeaderMatcher passes caller identity of http clients to grpc server in addition to default headers
+func gatewayHeaderMatcher(key string) (string, bool) {
+	if strings.EqualFold(key, callerHeader) {
+		return callerHeader, true
+	}
+	return runtime.DefaultHeaderMatcher(key)
+}
+
+func registerReshardingMetrics(reg prometheus.Registerer, db sharding.ClusterStorage) {
+	factory := promauto.With(reg)
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "storage_resharding_in_progress",
+		Help: "1 if keys are being moved to new shards count.",
+	}, func() float64 {
+		if db.ReshardingProgress().Completed {
+			return 0
+		}
+		return 1
+	})
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "storage_resharding_shards_done",
+		Help: "Shards scanned by resharding mover of this instance.",
+	}, func() float64 {
+		return float64(db.ReshardingProgress().ShardsDone)
+	})
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "storage_resharding_shards_total",
+		Help: "Shards which resharding mover scans.",
+	}, func() float64 {
+		return float64(db.ReshardingProgress().ShardsTotal)
+	})
+	factory.NewCounterFunc(prometheus.CounterOpts{
+		Name: "storage_resharding_rows_moved_total",
+		Help: "Records moved to new shards by resharding mover of this instance.",
+	}, func() float64 {
+		return float64(db.ReshardingProgress().RowsMoved)
+	})
+}
+
 func main() {
 	ctx := context.Background()
 	logger.SetLevel(zapcore.DebugLevel)
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		err := runMigrate(ctx, os.Args[2:])
+		if errors.Is(err, errMigrateUsage) {
+			fmt.Fprintln(os.Stderr, migrateUsage)
+			os.Exit(2)
+		}
+		if err != nil {
+			logger.FatalKV(ctx, "migrate", "error", err)
+		}
+		return
+	}
+
 	tracer, err := tracing.InitTracer("http://jaeger:14268/api/traces", serviceName)
 	if err != nil {
 		logger.FatalKV(ctx, "init tracer", "error", err)
@@ -85,23 +241,36 @@ func main() {
 		logger.PanicKV(ctx, "failed config initiating", "error", err)
 	}
 
-	db, err := database.InitDB(ctx, cfg, tracer)
+	reg := prometheus.NewRegistry()
+	db, watcher := initBackend(ctx, cfg, tracer, reg)
+
+	redisCache, err := cache.InitCache(cfg, tracer)
 	if err != nil {
-		logger.PanicKV(ctx, "failed create database conn", "error", err)
+		logger.PanicKV(ctx, "failed cache initiating", "error", err)
 	}
 
-	err = migrator.Migrate(db.GetDB(), cfg)
+	writePolicy, err := storage_with_cache.ParseWritePolicy(cfg.StorageWritePolicy)
 	if err != nil {
-		logger.PanicKV(ctx, "failed migrate process", "error", err)
+		logger.PanicKV(ctx, "failed parse write policy", "error", err)
 	}
-
-	redisCache, err := cache.InitCache(cfg, tracer)
+	// queued write and cached value are changed in one transaction, their keys belong to different slots in cluster
+	if writePolicy == storage_with_cache.WriteBehind && cfg.CacheMode == cache.ModeCluster {
+		logger.PanicKV(ctx, "write-behind policy isn't supported in redis cluster mode")
+	}
+	storage := storage_with_cache.NewStorage(
+		redisCache, db, tracer,
+		storage_with_cache.WithWritePolicy(writePolicy),
+		storage_with_cache.WithLoadTimeout(cfg.DBTimeout),
+	)
+	// reencryption drops cached values, so it starts when cache is ready
+	if r, ok := db.(reencrypter); ok && cfg.StorageReencryptOnStart {
+		go r.RunReencrypt(logger.WithName(ctx, "reencrypt"), storage)
+	}
+	warmUpOpts, err := storage_with_cache.WarmUpOptionsFromConfig(cfg)
 	if err != nil {
-		logger.PanicKV(ctx, "failed cache initiating", "error", err)
+		logger.PanicKV(ctx, "failed read cache warm-up options", "error", err)
 	}
 
-	storage := storage_with_cache.NewStorage(redisCache, db, tracer)
-
 	srvMetrics := grpcprom.NewServerMetrics(
 		grpcprom.WithServerHandlingTimeHistogram(
 			grpcprom.WithHistogramBuckets([]float64{0.001, 0.01, 0.1, 0.3, 0.6, 1, 3, 6, 9, 20, 30, 60, 90, 120}),
@@ -113,8 +282,16 @@ func main() {
 		),
 	)
 
-	reg := prometheus.NewRegistry()
 	reg.MustRegister(srvMetrics)
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "storage_cache_degraded",
+		Help: "1 if service works without cache because redis is unavailable.",
+	}, func() float64 {
+		if redisCache.Degraded() {
+			return 1
+		}
+		return 0
+	})
 	exemplarFromContext := func(ctx context.Context) prometheus.Labels {
 		if span := trace.SpanContextFromContext(ctx); span.IsSampled() {
 			return prometheus.Labels{"traceID": span.TraceID().String()}
@@ -162,10 +339,45 @@ func main() {
 			selector.UnaryServerInterceptor(auth.UnaryServerInterceptor(authFn), selector.MatchFunc(allButHealthZ)),
 			recovery.UnaryServerInterceptor(recovery.WithRecoveryHandler(grpcPanicRecoveryHandler)),
 			ratelimiter.UnaryServerInterceptor(redisCache.RedisClient(), cfg),
+			callerInterceptor(),
+		),
+		grpc.ChainStreamInterceptor(
+			otelgrpc.StreamServerInterceptor(),
+			srvMetrics.StreamServerInterceptor(grpcprom.WithExemplarFromContext(exemplarFromContext)),
+			logging.StreamServerInterceptor(interceptorLogger(), logging.WithFieldsFromContext(logTraceID)),
+			selector.StreamServerInterceptor(auth.StreamServerInterceptor(authFn), selector.MatchFunc(allButHealthZ)),
+			recovery.StreamServerInterceptor(recovery.WithRecoveryHandler(grpcPanicRecoveryHandler)),
 		),
 	)
+	// Service is serving without cache too, "cache" status shows degraded mode
+	healthSrv := health.NewServer()
+	setCacheStatus := func(degraded bool) {
+		cacheStatus := healthpb.HealthCheckResponse_SERVING
+		if degraded {
+			cacheStatus = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+		healthSrv.SetServingStatus("cache", cacheStatus)
+	}
+	redisCache.OnDegradedChange(setCacheStatus)
+	setCacheStatus(redisCache.Degraded())
+	healthpb.RegisterHealthServer(s, healthSrv)
+
+	// Service isn't ready until cache is warmed up or warm-up times out
+	healthSrv.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	go func() {
+		warmUpCtx, cancel := context.WithTimeout(logger.WithName(ctx, "warm-up"), cfg.CacheWarmUpTimeout)
+		defer cancel()
+		err := storage_with_cache.WarmUp(warmUpCtx, redisCache, db, warmUpOpts)
+		if err != nil {
+			logger.ErrorKV(warmUpCtx, "cache warm-up isn't completed", "error", err)
+		}
+		healthSrv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	}()
+
 	// Attach the Greeter service to the server
 	microservicepb2.RegisterHTTPMicroserviceServer(s, service.NewHandler(ctx, storage, tracer))
+	microservicepb2.RegisterKeyValueServer(s, service.NewKeyValueHandler(storage, watcher, tracer))
+	microservicepb2.RegisterAdminServer(s, service.NewAdminHandler(storage, tracer))
 
 	group, ctx := errgroup.WithContext(ctx)
 
@@ -218,11 +430,19 @@ func main() {
 		logger.PanicKV(ctx, "failed to dial server 8090", "error", err)
 	}
 
-	gwmux := runtime.NewServeMux()
+	gwmux := runtime.NewServeMux(runtime.WithIncomingHeaderMatcher(gatewayHeaderMatcher))
 	err = microservicepb2.RegisterHTTPMicroserviceHandler(ctx, gwmux, conn)
 	if err != nil {
 		logger.PanicKV(ctx, "failed to register gateway", "error", err)
 	}
+	err = microservicepb2.RegisterKeyValueHandler(ctx, gwmux, conn)
+	if err != nil {
+		logger.PanicKV(ctx, "failed to register key value gateway", "error", err)
+	}
+	err = microservicepb2.RegisterAdminHandler(ctx, gwmux, conn)
+	if err != nil {
+		logger.PanicKV(ctx, "failed to register admin gateway", "error", err)
+	}
 
 	gwServer := &http.Server{
 		Addr:    ":8090",
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/kjushka/microservice-gen/internal/config"
+	"github.com/kjushka/microservice-gen/internal/migrator"
+	"github.com/kjushka/microservice-gen/internal/storage/database"
+	"github.com/kjushka/microservice-gen/internal/storage/sharding"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const migrateUsage = `usage: microservice migrate <command>
+  up [N]       apply all or N next migrations
+  down N       roll back N last migrations
+  goto V       migrate up or down to version V
+  force V      set version V and clear dirty flag without running migrations
+  status       print current and latest versions
+  create NAME  add empty up and down files of new migration
+commands are applied to every shard schema if STORAGE_BACKEND is sharded`
+
+var errMigrateUsage = errors.New("invalid migrate command")
+
+// migrateArgs is parsed migrate command
+type migrateArgs struct {
+	name string
+	// count of up and down, zero count of up applies all migrations
+	n int
+	// version of goto and force
+	version int
+	// migration name of create
+	createName string
+}
+
+func parseMigrateArgs(args []string) (migrateArgs, error) {
+	if len(args) == 0 {
+		return migrateArgs{}, errMigrateUsage
+	}
+
+	var err error
+	parsed := migrateArgs{name: args[0]}
+	switch arg := args[1:]; {
+	case parsed.name == "create" && len(arg) == 1:
+		parsed.createName = arg[0]
+	case parsed.name == "up" && len(arg) <= 1:
+		if len(arg) == 1 {
+			parsed.n, err = positiveArg(arg[0])
+		}
+	case parsed.name == "down" && len(arg) == 1:
+		parsed.n, err = positiveArg(arg[0])
+	case parsed.name == "goto" && len(arg) == 1:
+		var version uint64
+		version, err = strconv.ParseUint(arg[0], 10, 32)
+		if err != nil {
+			return migrateArgs{}, fmt.Errorf("invalid version '%s': %v", arg[0], err)
+		}
+		parsed.version = int(version)
+	case parsed.name == "force" && len(arg) == 1:
+		// -1 means no migrations are applied
+		parsed.version, err = strconv.Atoi(arg[0])
+		if err != nil || parsed.version < -1 {
+			return migrateArgs{}, fmt.Errorf("invalid version '%s'", arg[0])
+		}
+	case parsed.name == "status" && len(arg) == 0:
+	default:
+		return migrateArgs{}, errMigrateUsage
+	}
+	if err != nil {
+		return migrateArgs{}, err
+	}
+	return parsed, nil
+}
+
+// command is nil for status and create
+func (a migrateArgs) command() migrator.Command {
+	switch a.name {
+	case "up":
+		return migrator.Up(a.n)
+	case "down":
+		return migrator.Down(a.n)
+	case "goto":
+		return migrator.Goto(uint(a.version))
+	case "force":
+		return migrator.Force(a.version)
+	default:
+		return nil
+	}
+}
+
+// runMigrate handles migrate subcommand, database is taken from the same config as service uses.
+// Create needs only migrations directory, so it works without database settings
+func runMigrate(ctx context.Context, args []string) error {
+	parsed, err := parseMigrateArgs(args)
+	if err != nil {
+		return err
+	}
+
+	if parsed.name == "create" {
+		paths, err := migrator.Create(config.MigrationsDir(), parsed.createName)
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			fmt.Println(path)
+		}
+		return nil
+	}
+
+	cfg, err := config.InitConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("failed config initiating: %v", err)
+	}
+	mg := migrator.InitMigrator(cfg)
+	cmd, status := parsed.command(), parsed.name == "status"
+	tracer := trace.NewNoopTracerProvider().Tracer("migrate")
+
+	switch cfg.StorageBackend {
+	case "postgres":
+		db, err := database.InitDB(ctx, cfg, tracer)
+		if err != nil {
+			return fmt.Errorf("failed create database conn: %v", err)
+		}
+		if !status {
+			err = mg.Run(ctx, db.GetDB(), cmd)
+			if err != nil {
+				return err
+			}
+		}
+
+		s, err := mg.GetStatus(ctx, db.GetDB())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("version %d of %d, dirty: %t\n", s.Version, s.Latest, s.Dirty)
+		return nil
+	case "sharded":
+		db, err := sharding.InitDB(ctx, cfg, tracer)
+		if err != nil {
+			return fmt.Errorf("failed create sharded database conn: %v", err)
+		}
+		var runErr error
+		if !status {
+			runErr = mg.RunShards(ctx, cfg.DBShardServers, db.ShardSchemas(), cmd)
+		}
+
+		report, err := mg.ShardsStatus(ctx, cfg.DBShardServers, db.ShardSchemas())
+		if err != nil {
+			return err
+		}
+		behind := report.Behind()
+		fmt.Printf("%d of %d shards are behind latest version %d\n", len(behind), len(report.Shards), report.Latest)
+		for _, shard := range behind {
+			fmt.Printf("  %s on %s: version %d, dirty: %t\n", shard.Schema, shard.Server, shard.Version, shard.Dirty)
+		}
+		return runErr
+	default:
+		return fmt.Errorf("unknown storage backend '%s'", cfg.StorageBackend)
+	}
+}
+
+func positiveArg(arg string) (int, error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid count '%s', it must be positive", arg)
+	}
+	return n, nil
+}
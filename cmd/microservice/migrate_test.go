@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseMigrateArgs(t *testing.T) {
+	tests := []struct {
+		args  string
+		want  migrateArgs
+		usage bool
+		fails bool
+	}{
+		{args: "up", want: migrateArgs{name: "up"}},
+		{args: "up 2", want: migrateArgs{name: "up", n: 2}},
+		{args: "up 0", fails: true},
+		{args: "up x", fails: true},
+		{args: "up 1 2", usage: true},
+		{args: "down 3", want: migrateArgs{name: "down", n: 3}},
+		{args: "down", usage: true},
+		{args: "down -1", fails: true},
+		{args: "goto 5", want: migrateArgs{name: "goto", version: 5}},
+		{args: "goto 0", want: migrateArgs{name: "goto", version: 0}},
+		{args: "goto -1", fails: true},
+		{args: "goto", usage: true},
+		{args: "force 4", want: migrateArgs{name: "force", version: 4}},
+		{args: "force -1", want: migrateArgs{name: "force", version: -1}},
+		{args: "force -2", fails: true},
+		{args: "force 1 2", usage: true},
+		{args: "status", want: migrateArgs{name: "status"}},
+		{args: "status 1", usage: true},
+		{args: "create add_users", want: migrateArgs{name: "create", createName: "add_users"}},
+		{args: "create", usage: true},
+		{args: "", usage: true},
+		{args: "drop", usage: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.args, func(t *testing.T) {
+			got, err := parseMigrateArgs(strings.Fields(tt.args))
+			switch {
+			case tt.usage:
+				if !errors.Is(err, errMigrateUsage) {
+					t.Fatalf("error is %v, want usage error", err)
+				}
+			case tt.fails:
+				if err == nil || errors.Is(err, errMigrateUsage) {
+					t.Fatalf("error is %v, want invalid argument error", err)
+				}
+			default:
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != tt.want {
+					t.Fatalf("parsed %+v, want %+v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseMigrateArgsCommand(t *testing.T) {
+	for _, args := range []string{"up", "up 1", "down 1", "goto 1", "force 1"} {
+		parsed, err := parseMigrateArgs(strings.Fields(args))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.command() == nil {
+			t.Fatalf("'%s' has no command", args)
+		}
+	}
+	for _, args := range []string{"status", "create name"} {
+		parsed, err := parseMigrateArgs(strings.Fields(args))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.command() != nil {
+			t.Fatalf("'%s' has command", args)
+		}
+	}
+}
@@ -1,17 +1,20 @@
 module github.com/kjushka/microservice-gen
 
-go 1.19
+go 1.22
 
 require (
 	github.com/benbjohnson/clock v1.3.4
 	github.com/cenkalti/backoff/v3 v3.2.2
+	github.com/fxamacker/cbor/v2 v2.4.0
 	github.com/go-pg/pg/v10 v10.11.0
 	github.com/go-pg/sharding/v8 v8.0.0
 	github.com/golang-migrate/migrate/v4 v4.15.2
+	github.com/golang/snappy v0.0.4
 	github.com/grpc-ecosystem/go-grpc-middleware/providers/prometheus v1.0.0-rc.0
 	github.com/grpc-ecosystem/go-grpc-middleware/v2 v2.0.0-rc.5
 	github.com/grpc-ecosystem/grpc-gateway/v2 v2.15.2
 	github.com/jmoiron/sqlx v1.3.5
+	github.com/klauspost/compress v1.18.0
 	github.com/lib/pq v1.10.9
 	github.com/mennanov/limiters v1.2.0
 	github.com/mercari/go-circuitbreaker v0.0.2
@@ -84,6 +87,7 @@ require (
 	github.com/vmihailenco/bufpool v0.1.11 // indirect
 	github.com/vmihailenco/tagparser v0.1.2 // indirect
 	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	go.etcd.io/etcd/api/v3 v3.5.7 // indirect
 	go.etcd.io/etcd/client/pkg/v3 v3.5.7 // indirect
 	go.etcd.io/etcd/client/v3 v3.5.7 // indirect
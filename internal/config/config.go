@@ -2,22 +2,68 @@ package config
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/kjushka/microservice-gen/internal/logger"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// DBServer is physical postgres server of sharded storage
+type DBServer struct {
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Database string `json:"database"`
+	// zero means default pool size
+	PoolSize int `json:"pool_size"`
+}
+
 type Config struct {
 	DBHost, DBPort, Database, DBUser, DBPass string
 	DBTimeout                                time.Duration
 	DBShardsCount                            int
-	CachePort                                string
+	DBShardServers                           []DBServer // logical shards are spread over them evenly
+	DBReshardTo                              int        // target shards count of online resharding, zero if there is none
+	DBReshardFromLegacyHash                  bool       // keys were routed by fnv32a % DBShardsCount before jump hash
+	DBReplicas                               []DBServer // read replicas of PG_HOST
+	DBReplicaMaxLag                          time.Duration
+	DBReadYourWritesWindow                   time.Duration // caller reads primary for this time after its write
+	DBSweepInterval                          time.Duration
+	DBEventsRetention                        time.Duration
+	DBMigrateOnStart                         bool   // otherwise migrations are applied by migrate subcommand
+	DBMigrationsDir                          string // overrides embedded migrations for development
+	DBMigrateLockTimeout                     time.Duration
+	CacheMode                                string // standalone, sentinel or cluster
+	CacheAddrs                               []string
+	CacheMasterName                          string // only for sentinel mode
+	CacheUsername, CachePassword             string
+	CacheDB                                  int
+	CacheTLS                                 bool
+	CacheTLSCAFile                           string // empty if system roots are used
 	CacheTimeout                             time.Duration
 	CacheExpirationTime                      time.Duration
+	CacheL1Size                              int64         // zero if local cache is disabled
+	CacheSoftTTL                             time.Duration // zero if stale values aren't served
+	CacheNegativeTTL                         time.Duration // zero if missing records aren't cached
+	CacheWarmUpTables                        []string      // recent keys of these tables are warmed up
+	CacheWarmUpRecent                        int           // zero if recent keys aren't warmed up
+	CacheWarmUpKeysFile                      string        // empty if there are no listed keys
+	CacheWarmUpConcurrency                   int
+	CacheWarmUpTimeout                       time.Duration
 	RateLimiterCapacity                      int64
+	StorageSerializer                        string
+	StorageCompression                       string
+	StorageCompressionThreshold              int
+	StorageEncryptionKeyfile                 string // empty if stored values aren't encrypted
+	StorageReencryptOnStart                  bool   // rewrites records encrypted by old keys of keyfile
+	StorageWritePolicy                       string
+	StorageBackend                           string // postgres or sharded
+	StorageWatch                             bool   // serves Watch rpc, sharded backend doesn't publish events for it
 }
 
 func InitConfig(ctx context.Context) (*Config, error) {
@@ -57,10 +103,144 @@ func InitConfig(ctx context.Context) (*Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed parse pgsql shards count: %v", err)
 	}
+	// zero means keys aren't moved
+	pgReshardToStr, ok := os.LookupEnv("PG_RESHARD_TO")
+	if !ok {
+		return nil, errors.New("PG_RESHARD_TO not found")
+	}
+	pgReshardTo, err := strconv.Atoi(pgReshardToStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse pgsql resharding target: %v", err)
+	}
+	// true for data written before shards were chosen by jump hash
+	pgReshardFromLegacyHashStr, ok := os.LookupEnv("PG_RESHARD_FROM_LEGACY_HASH")
+	if !ok {
+		return nil, errors.New("PG_RESHARD_FROM_LEGACY_HASH not found")
+	}
+	pgReshardFromLegacyHash, err := strconv.ParseBool(pgReshardFromLegacyHashStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse pgsql resharding from legacy hash: %v", err)
+	}
+	// empty list means one server from PG_HOST and the rest of PG_ variables
+	pgShardServersStr, ok := os.LookupEnv("PG_SHARD_SERVERS")
+	if !ok {
+		return nil, errors.New("PG_SHARD_SERVERS not found")
+	}
+	pgShardServers := []DBServer{{Host: pgHost, Port: pgPort, User: pgUser, Password: pgPass, Database: database}}
+	if pgShardServersStr != "" {
+		pgShardServers = nil
+		err = json.Unmarshal([]byte(pgShardServersStr), &pgShardServers)
+		if err != nil {
+			return nil, fmt.Errorf("failed parse pgsql shard servers: %v", err)
+		}
+	}
+	// empty list means reads go to primary
+	pgReplicasStr, ok := os.LookupEnv("PG_REPLICAS")
+	if !ok {
+		return nil, errors.New("PG_REPLICAS not found")
+	}
+	var pgReplicas []DBServer
+	if pgReplicasStr != "" {
+		err = json.Unmarshal([]byte(pgReplicasStr), &pgReplicas)
+		if err != nil {
+			return nil, fmt.Errorf("failed parse pgsql replicas: %v", err)
+		}
+	}
+	pgReplicaMaxLagStr, ok := os.LookupEnv("PG_REPLICA_MAX_LAG")
+	if !ok {
+		return nil, errors.New("PG_REPLICA_MAX_LAG not found")
+	}
+	pgReplicaMaxLag, err := time.ParseDuration(pgReplicaMaxLagStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse pgsql replica max lag: %v", err)
+	}
+	// zero disables read-your-writes
+	pgReadYourWritesStr, ok := os.LookupEnv("PG_READ_YOUR_WRITES_WINDOW")
+	if !ok {
+		return nil, errors.New("PG_READ_YOUR_WRITES_WINDOW not found")
+	}
+	pgReadYourWrites, err := time.ParseDuration(pgReadYourWritesStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse pgsql read your writes window: %v", err)
+	}
+	pgSweepIntervalStr, ok := os.LookupEnv("PG_SWEEP_INTERVAL")
+	if !ok {
+		return nil, errors.New("PG_SWEEP_INTERVAL not found")
+	}
+	pgSweepInterval, err := time.ParseDuration(pgSweepIntervalStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse pgsql sweep interval: %v", err)
+	}
+	pgEventsRetentionStr, ok := os.LookupEnv("PG_EVENTS_RETENTION")
+	if !ok {
+		return nil, errors.New("PG_EVENTS_RETENTION not found")
+	}
+	pgEventsRetention, err := time.ParseDuration(pgEventsRetentionStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse pgsql events retention: %v", err)
+	}
+	pgMigrateOnStartStr, ok := os.LookupEnv("PG_MIGRATE_ON_START")
+	if !ok {
+		return nil, errors.New("PG_MIGRATE_ON_START not found")
+	}
+	pgMigrateOnStart, err := strconv.ParseBool(pgMigrateOnStartStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse pgsql migrate on start: %v", err)
+	}
+	// empty means migrations compiled into binary
+	pgMigrationsDir, ok := os.LookupEnv("PG_MIGRATIONS_DIR")
+	if !ok {
+		return nil, errors.New("PG_MIGRATIONS_DIR not found")
+	}
+	pgMigrateLockTimeoutStr, ok := os.LookupEnv("PG_MIGRATE_LOCK_TIMEOUT")
+	if !ok {
+		return nil, errors.New("PG_MIGRATE_LOCK_TIMEOUT not found")
+	}
+	pgMigrateLockTimeout, err := time.ParseDuration(pgMigrateLockTimeoutStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse pgsql migrate lock timeout: %v", err)
+	}
 
-	redisPort, ok := os.LookupEnv("REDIS_PORT")
+	redisMode, ok := os.LookupEnv("REDIS_MODE")
 	if !ok {
-		return nil, errors.New("REDIS_PORT not found")
+		return nil, errors.New("REDIS_MODE not found")
+	}
+	redisAddrsStr, ok := os.LookupEnv("REDIS_ADDRS")
+	if !ok {
+		return nil, errors.New("REDIS_ADDRS not found")
+	}
+	redisAddrs := strings.Split(redisAddrsStr, ",")
+	redisMasterName, ok := os.LookupEnv("REDIS_MASTER_NAME")
+	if !ok {
+		return nil, errors.New("REDIS_MASTER_NAME not found")
+	}
+	redisUsername, ok := os.LookupEnv("REDIS_USERNAME")
+	if !ok {
+		return nil, errors.New("REDIS_USERNAME not found")
+	}
+	redisPassword, ok := os.LookupEnv("REDIS_PASSWORD")
+	if !ok {
+		return nil, errors.New("REDIS_PASSWORD not found")
+	}
+	redisDBStr, ok := os.LookupEnv("REDIS_DB")
+	if !ok {
+		return nil, errors.New("REDIS_DB not found")
+	}
+	redisDB, err := strconv.Atoi(redisDBStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse redis db: %v", err)
+	}
+	redisTLSStr, ok := os.LookupEnv("REDIS_TLS")
+	if !ok {
+		return nil, errors.New("REDIS_TLS not found")
+	}
+	redisTLS, err := strconv.ParseBool(redisTLSStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse redis tls: %v", err)
+	}
+	redisTLSCAFile, ok := os.LookupEnv("REDIS_TLS_CA_FILE")
+	if !ok {
+		return nil, errors.New("REDIS_TLS_CA_FILE not found")
 	}
 	redisTimeoutStr, ok := os.LookupEnv("REDIS_TIMEOUT")
 	if !ok {
@@ -79,6 +259,68 @@ func InitConfig(ctx context.Context) (*Config, error) {
 		return nil, fmt.Errorf("failed parse redis expiration time: %v", err)
 	}
 
+	cacheSoftTTLStr, ok := os.LookupEnv("CACHE_SOFT_TTL")
+	if !ok {
+		return nil, errors.New("CACHE_SOFT_TTL not found")
+	}
+	cacheSoftTTL, err := time.ParseDuration(cacheSoftTTLStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse cache soft ttl: %v", err)
+	}
+	cacheNegativeTTLStr, ok := os.LookupEnv("CACHE_NEGATIVE_TTL")
+	if !ok {
+		return nil, errors.New("CACHE_NEGATIVE_TTL not found")
+	}
+	cacheNegativeTTL, err := time.ParseDuration(cacheNegativeTTLStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse cache negative ttl: %v", err)
+	}
+	cacheL1SizeStr, ok := os.LookupEnv("CACHE_L1_SIZE")
+	if !ok {
+		return nil, errors.New("CACHE_L1_SIZE not found")
+	}
+	cacheL1Size, err := strconv.ParseInt(cacheL1SizeStr, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse local cache size: %v", err)
+	}
+
+	cacheWarmUpTablesStr, ok := os.LookupEnv("CACHE_WARMUP_TABLES")
+	if !ok {
+		return nil, errors.New("CACHE_WARMUP_TABLES not found")
+	}
+	var cacheWarmUpTables []string
+	if cacheWarmUpTablesStr != "" {
+		cacheWarmUpTables = strings.Split(cacheWarmUpTablesStr, ",")
+	}
+	cacheWarmUpRecentStr, ok := os.LookupEnv("CACHE_WARMUP_RECENT")
+	if !ok {
+		return nil, errors.New("CACHE_WARMUP_RECENT not found")
+	}
+	cacheWarmUpRecent, err := strconv.Atoi(cacheWarmUpRecentStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse cache warm-up recent keys count: %v", err)
+	}
+	cacheWarmUpKeysFile, ok := os.LookupEnv("CACHE_WARMUP_KEYS_FILE")
+	if !ok {
+		return nil, errors.New("CACHE_WARMUP_KEYS_FILE not found")
+	}
+	cacheWarmUpConcurrencyStr, ok := os.LookupEnv("CACHE_WARMUP_CONCURRENCY")
+	if !ok {
+		return nil, errors.New("CACHE_WARMUP_CONCURRENCY not found")
+	}
+	cacheWarmUpConcurrency, err := strconv.Atoi(cacheWarmUpConcurrencyStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse cache warm-up concurrency: %v", err)
+	}
+	cacheWarmUpTimeoutStr, ok := os.LookupEnv("CACHE_WARMUP_TIMEOUT")
+	if !ok {
+		return nil, errors.New("CACHE_WARMUP_TIMEOUT not found")
+	}
+	cacheWarmUpTimeout, err := time.ParseDuration(cacheWarmUpTimeoutStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse cache warm-up timeout: %v", err)
+	}
+
 	rateLimiterCapacityStr, ok := os.LookupEnv("RATE_LIMITER_CAPACITY")
 	if !ok {
 		return nil, errors.New("RATE_LIMITER_CAPACITY not found")
@@ -88,21 +330,155 @@ func InitConfig(ctx context.Context) (*Config, error) {
 		return nil, fmt.Errorf("failed parse rate limiter capacity: %v", err)
 	}
 
+	storageSerializer, ok := os.LookupEnv("STORAGE_SERIALIZER")
+	if !ok {
+		return nil, errors.New("STORAGE_SERIALIZER not found")
+	}
+	storageCompression, ok := os.LookupEnv("STORAGE_COMPRESSION")
+	if !ok {
+		return nil, errors.New("STORAGE_COMPRESSION not found")
+	}
+	storageCompressionThresholdStr, ok := os.LookupEnv("STORAGE_COMPRESSION_THRESHOLD")
+	if !ok {
+		return nil, errors.New("STORAGE_COMPRESSION_THRESHOLD not found")
+	}
+	storageCompressionThreshold, err := strconv.Atoi(storageCompressionThresholdStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse storage compression threshold: %v", err)
+	}
+
+	storageEncryptionKeyfile, ok := os.LookupEnv("STORAGE_ENCRYPTION_KEYFILE")
+	if !ok {
+		return nil, errors.New("STORAGE_ENCRYPTION_KEYFILE not found")
+	}
+	storageReencryptOnStartStr, ok := os.LookupEnv("STORAGE_REENCRYPT_ON_START")
+	if !ok {
+		return nil, errors.New("STORAGE_REENCRYPT_ON_START not found")
+	}
+	storageReencryptOnStart, err := strconv.ParseBool(storageReencryptOnStartStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse storage reencrypt on start: %v", err)
+	}
+
+	storageWritePolicy, ok := os.LookupEnv("STORAGE_WRITE_POLICY")
+	if !ok {
+		return nil, errors.New("STORAGE_WRITE_POLICY not found")
+	}
+
+	storageBackend, ok := os.LookupEnv("STORAGE_BACKEND")
+	if !ok {
+		return nil, errors.New("STORAGE_BACKEND not found")
+	}
+	storageWatchStr, ok := os.LookupEnv("STORAGE_WATCH")
+	if !ok {
+		return nil, errors.New("STORAGE_WATCH not found")
+	}
+	storageWatch, err := strconv.ParseBool(storageWatchStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse storage watch: %v", err)
+	}
+
 	config := &Config{
-		DBHost:              pgHost,
-		DBPort:              pgPort,
-		DBUser:              pgUser,
-		DBPass:              pgPass,
-		Database:            database,
-		DBTimeout:           pgTimeout,
-		DBShardsCount:       pgShards,
-		CachePort:           redisPort,
-		CacheTimeout:        redisTimeout,
-		CacheExpirationTime: redisExpirationTime,
-		RateLimiterCapacity: rateLimiterCapacity,
+		DBHost:                      pgHost,
+		DBPort:                      pgPort,
+		DBUser:                      pgUser,
+		DBPass:                      pgPass,
+		Database:                    database,
+		DBTimeout:                   pgTimeout,
+		DBShardsCount:               pgShards,
+		DBShardServers:              pgShardServers,
+		DBReshardTo:                 pgReshardTo,
+		DBReshardFromLegacyHash:     pgReshardFromLegacyHash,
+		DBReplicas:                  pgReplicas,
+		DBReplicaMaxLag:             pgReplicaMaxLag,
+		DBReadYourWritesWindow:      pgReadYourWrites,
+		DBSweepInterval:             pgSweepInterval,
+		DBEventsRetention:           pgEventsRetention,
+		DBMigrateOnStart:            pgMigrateOnStart,
+		DBMigrationsDir:             pgMigrationsDir,
+		DBMigrateLockTimeout:        pgMigrateLockTimeout,
+		CacheMode:                   redisMode,
+		CacheAddrs:                  redisAddrs,
+		CacheMasterName:             redisMasterName,
+		CacheUsername:               redisUsername,
+		CachePassword:               redisPassword,
+		CacheDB:                     redisDB,
+		CacheTLS:                    redisTLS,
+		CacheTLSCAFile:              redisTLSCAFile,
+		CacheTimeout:                redisTimeout,
+		CacheExpirationTime:         redisExpirationTime,
+		CacheL1Size:                 cacheL1Size,
+		CacheSoftTTL:                cacheSoftTTL,
+		CacheNegativeTTL:            cacheNegativeTTL,
+		CacheWarmUpTables:           cacheWarmUpTables,
+		CacheWarmUpRecent:           cacheWarmUpRecent,
+		CacheWarmUpKeysFile:         cacheWarmUpKeysFile,
+		CacheWarmUpConcurrency:      cacheWarmUpConcurrency,
+		CacheWarmUpTimeout:          cacheWarmUpTimeout,
+		RateLimiterCapacity:         rateLimiterCapacity,
+		StorageSerializer:           storageSerializer,
+		StorageCompression:          storageCompression,
+		StorageCompressionThreshold: storageCompressionThreshold,
+		StorageEncryptionKeyfile:    storageEncryptionKeyfile,
+		StorageReencryptOnStart:     storageReencryptOnStart,
+		StorageWritePolicy:          storageWritePolicy,
+		StorageBackend:              storageBackend,
+		StorageWatch:                storageWatch,
+	}
+	err = config.Validate()
+	if err != nil {
+		return nil, err
 	}
 
-	logger.InfoKV(ctx, "config initialized", "config", config)
+	logger.InfoKV(ctx, "config initialized", "config", config.Redacted())
 
 	return config, nil
 }
+
+// MigrationsDir returns PG_MIGRATIONS_DIR, it's the only setting migration creation needs,
+// so new migration is created without database settings. Empty means migrations compiled into binary
+func MigrationsDir() string {
+	return os.Getenv("PG_MIGRATIONS_DIR")
+}
+
+// Validate rejects combinations of options which can't work together
+func (c *Config) Validate() error {
+	// shard writes don't insert storage events, so watchers would never get changes
+	if c.StorageBackend == "sharded" && c.StorageWatch {
+		return errors.New("STORAGE_WATCH isn't supported by sharded backend, set STORAGE_WATCH=false")
+	}
+	return nil
+}
+
+// secretMask replaces non-empty secrets in logged config
+const secretMask = "***"
+
+// Redacted returns copy of config which is safe to log, passwords are masked
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	redacted.DBPass = maskSecret(c.DBPass)
+	redacted.CachePassword = maskSecret(c.CachePassword)
+	redacted.DBShardServers = redactServers(c.DBShardServers)
+	redacted.DBReplicas = redactServers(c.DBReplicas)
+	return &redacted
+}
+
+func redactServers(servers []DBServer) []DBServer {
+	if servers == nil {
+		return nil
+	}
+	redacted := make([]DBServer, len(servers))
+	for i, server := range servers {
+		server.Password = maskSecret(server.Password)
+		redacted[i] = server
+	}
+	return redacted
+}
+
+// maskSecret keeps empty secret empty, so unset one is still visible
+func maskSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return secretMask
+}
@@ -0,0 +1,64 @@
+package config
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend string
+		watch   bool
+		valid   bool
+	}{
+		{name: "postgres with watch", backend: "postgres", watch: true, valid: true},
+		{name: "postgres without watch", backend: "postgres", watch: false, valid: true},
+		{name: "sharded without watch", backend: "sharded", watch: false, valid: true},
+		{name: "sharded with watch", backend: "sharded", watch: true, valid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{StorageBackend: tt.backend, StorageWatch: tt.watch}
+			err := cfg.Validate()
+			if (err == nil) != tt.valid {
+				t.Fatalf("validate error is %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	cfg := &Config{
+		DBPass:         "pg-secret",
+		DBShardServers: []DBServer{{Host: "shard-0", Password: "shard-secret"}, {Host: "shard-1"}},
+		DBReplicas:     []DBServer{{Host: "replica", Password: "replica-secret"}},
+		// sentinel mode authenticates with cache password too
+		CacheMode:       "sentinel",
+		CacheMasterName: "master",
+		CacheUsername:   "user",
+		CachePassword:   "redis-secret",
+	}
+
+	redacted := cfg.Redacted()
+	secrets := map[string]string{
+		"postgres":    redacted.DBPass,
+		"first shard": redacted.DBShardServers[0].Password,
+		"replica":     redacted.DBReplicas[0].Password,
+		"redis":       redacted.CachePassword,
+	}
+	for name, secret := range secrets {
+		if secret != secretMask {
+			t.Fatalf("%s password is '%s', want '%s'", name, secret, secretMask)
+		}
+	}
+	if password := redacted.DBShardServers[1].Password; password != "" {
+		t.Fatalf("unset password is '%s', want empty", password)
+	}
+	if redacted.DBShardServers[0].Host != "shard-0" || redacted.CacheUsername != "user" {
+		t.Fatal("settings other than passwords are changed")
+	}
+
+	// logged copy doesn't change config which is used for connections
+	if cfg.DBPass != "pg-secret" || cfg.CachePassword != "redis-secret" ||
+		cfg.DBShardServers[0].Password != "shard-secret" || cfg.DBReplicas[0].Password != "replica-secret" {
+		t.Fatal("redaction changed config")
+	}
+}
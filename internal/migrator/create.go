@@ -0,0 +1,62 @@
+package migrator
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	migrationNameRe = regexp.MustCompile(`^[a-z0-9_]+$`)
+	migrationFileRe = regexp.MustCompile(`^([0-9]+)_.*\.(up|down)\.sql$`)
+)
+
+// Create adds empty up and down files of migration with next sequence number to migrations directory dir
+// and returns their paths. Empty dir means embedded migrations, they are created in ./migrations
+// and binary must be rebuilt to get them
+func Create(dir, name string) ([]string, error) {
+	if !migrationNameRe.MatchString(name) {
+		return nil, fmt.Errorf("invalid migration name '%s', use lowercase letters, digits and '_'", name)
+	}
+
+	if dir == "" {
+		dir = defaultMigrationsDir
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "error in read migrations dir")
+	}
+	var last uint64
+	for _, entry := range entries {
+		match := migrationFileRe.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+		version, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error in parse version of '%s'", entry.Name())
+		}
+		if version > last {
+			last = version
+		}
+	}
+
+	base := fmt.Sprintf("%02d_%s", last+1, name)
+	paths := []string{
+		filepath.Join(dir, base+".up.sql"),
+		filepath.Join(dir, base+".down.sql"),
+	}
+	for _, path := range paths {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, errors.Wrap(err, "error in create migration file")
+		}
+		_ = f.Close()
+	}
+
+	return paths, nil
+}
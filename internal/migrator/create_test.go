@@ -0,0 +1,97 @@
+package migrator
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreate(t *testing.T) {
+	t.Run("first migration", func(t *testing.T) {
+		dir := t.TempDir()
+		paths, err := Create(dir, "init")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{filepath.Join(dir, "01_init.up.sql"), filepath.Join(dir, "01_init.down.sql")}
+		assertPaths(t, paths, want)
+	})
+
+	t.Run("next after highest version", func(t *testing.T) {
+		dir := t.TempDir()
+		for _, name := range []string{
+			"01_init.up.sql", "01_init.down.sql",
+			"09_items.up.sql", "09_items.down.sql",
+			"03_events.up.sql",
+			// files not matching migration name don't count
+			"100_readme.md", "embed.go",
+		} {
+			err := os.WriteFile(filepath.Join(dir, name), nil, 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		paths, err := Create(dir, "add_users")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{filepath.Join(dir, "10_add_users.up.sql"), filepath.Join(dir, "10_add_users.down.sql")}
+		assertPaths(t, paths, want)
+	})
+
+	t.Run("three digit version", func(t *testing.T) {
+		dir := t.TempDir()
+		err := os.WriteFile(filepath.Join(dir, "99_last.up.sql"), nil, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths, err := Create(dir, "next")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertPaths(t, paths, []string{filepath.Join(dir, "100_next.up.sql"), filepath.Join(dir, "100_next.down.sql")})
+	})
+
+	t.Run("invalid name", func(t *testing.T) {
+		dir := t.TempDir()
+		for _, name := range []string{"", "Add", "add-users", "../users"} {
+			_, err := Create(dir, name)
+			if err == nil {
+				t.Fatalf("migration '%s' is created", name)
+			}
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Fatalf("%d files are created", len(entries))
+		}
+	})
+
+	t.Run("missing dir", func(t *testing.T) {
+		_, err := Create(filepath.Join(t.TempDir(), "missing"), "init")
+		if err == nil {
+			t.Fatal("migration is created in missing dir")
+		}
+	})
+}
+
+func assertPaths(t *testing.T, paths, want []string) {
+	t.Helper()
+	if len(paths) != len(want) {
+		t.Fatalf("paths are %v, want %v", paths, want)
+	}
+	for i := range want {
+		if paths[i] != want[i] {
+			t.Fatalf("paths are %v, want %v", paths, want)
+		}
+		info, err := os.Stat(paths[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != 0 {
+			t.Fatalf("'%s' isn't empty", paths[i])
+		}
+	}
+}
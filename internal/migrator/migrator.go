@@ -1,36 +1,250 @@
 package migrator
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file" // import for reading migrations file
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
 	"github.com/jmoiron/sqlx"
 	"github.com/kjushka/microservice-gen/internal/config"
+	"github.com/kjushka/microservice-gen/migrations"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 )
 
-func Migrate(db *sqlx.DB, cfg *config.Config) error {
-	driver, err := postgres.WithInstance(db.DB, &postgres.Config{
-		DatabaseName: cfg.Database,
+const (
+	// defaultMigrationsDir is used by create command if migrations are embedded
+	defaultMigrationsDir = "./migrations"
+
+	// migrationsLockID lets only one replica change schemas of server at a time
+	migrationsLockID = 2023060300
+	lockRetryDelay   = 500 * time.Millisecond
+)
+
+// Migrator applies migrations compiled into binary or migrations of directory if it is configured
+type Migrator struct {
+	fsys fs.FS
+	// empty if migrations are embedded
+	dir         string
+	lockTimeout time.Duration
+}
+
+func InitMigrator(cfg *config.Config) *Migrator {
+	m := &Migrator{
+		fsys:        migrations.FS,
+		dir:         cfg.DBMigrationsDir,
+		lockTimeout: cfg.DBMigrateLockTimeout,
+	}
+	if m.dir != "" {
+		m.fsys = os.DirFS(m.dir)
+	}
+	return m
+}
+
+func (mg *Migrator) source() (source.Driver, error) {
+	src, err := iofs.New(mg.fsys, ".")
+	if err != nil {
+		return nil, errors.Wrap(err, "error in open migrations")
+	}
+	return src, nil
+}
+
+// Command changes schema version of one database or one shard schema
+type Command func(m *migrate.Migrate) error
+
+// Up applies n next migrations, zero n applies all of them
+func Up(n int) Command {
+	return func(m *migrate.Migrate) error {
+		if n == 0 {
+			return m.Up()
+		}
+		return m.Steps(n)
+	}
+}
+
+// Down rolls back n last migrations
+func Down(n int) Command {
+	return func(m *migrate.Migrate) error {
+		return m.Steps(-n)
+	}
+}
+
+// Goto migrates up or down to version
+func Goto(version uint) Command {
+	return func(m *migrate.Migrate) error {
+		return m.Migrate(version)
+	}
+}
+
+// Force sets version and clears dirty flag without running migrations,
+// it's used after schema is fixed by hand
+func Force(version int) Command {
+	return func(m *migrate.Migrate) error {
+		return m.Force(version)
+	}
+}
+
+// DirtyError means migration failed in the middle and schema is in unknown state.
+// Nothing is rolled back automatically, schema must be fixed by hand and then forced
+type DirtyError struct {
+	// empty for not sharded database
+	Schema  string
+	Version int
+}
+
+func (e *DirtyError) Error() string {
+	target := "database"
+	if e.Schema != "" {
+		target = "schema " + e.Schema
+	}
+	return fmt.Sprintf(
+		"%s is dirty at version %d: migration failed in the middle, fix schema by hand "+
+			"and run 'migrate force V' with version V schema matches",
+		target, e.Version,
+	)
+}
+
+// Migrate applies all migrations. Failed migration isn't rolled back, it leaves database dirty
+func (mg *Migrator) Migrate(ctx context.Context, db *sqlx.DB) error {
+	return mg.Run(ctx, db, Up(0))
+}
+
+// Run applies command to database, command without changes isn't an error
+func (mg *Migrator) Run(ctx context.Context, db *sqlx.DB, cmd Command) error {
+	return mg.withLock(ctx, db.DB, func() error {
+		return mg.run(ctx, db.DB, "", cmd)
 	})
+}
+
+type Status struct {
+	// zero if no migrations are applied
+	Version uint
+	Dirty   bool
+	// version of the last migration in migrations set
+	Latest uint
+}
+
+func (mg *Migrator) GetStatus(ctx context.Context, db *sqlx.DB) (Status, error) {
+	latest, err := mg.latestVersion()
+	if err != nil {
+		return Status{}, err
+	}
+
+	status := Status{Latest: latest}
+	err = mg.run(ctx, db.DB, "", func(m *migrate.Migrate) error {
+		var err error
+		status.Version, status.Dirty, err = m.Version()
+		if err == migrate.ErrNilVersion {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return Status{}, err
+	}
+
+	return status, nil
+}
+
+// CheckClean returns DirtyError if the last migration failed, service mustn't start on such database
+func (mg *Migrator) CheckClean(ctx context.Context, db *sqlx.DB) error {
+	status, err := mg.GetStatus(ctx, db)
+	if err != nil {
+		return err
+	}
+	if status.Dirty {
+		return &DirtyError{Version: int(status.Version)}
+	}
+	return nil
+}
+
+// run applies command on its own connection, non-empty schema becomes search path of it,
+// so unqualified names of migrations belong to that schema
+func (mg *Migrator) run(ctx context.Context, db *sql.DB, schema string, cmd Command) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error in get connection")
+	}
+	defer func() { _ = conn.Close() }()
+
+	driverCfg := &postgres.Config{}
+	if schema != "" {
+		_, err = conn.ExecContext(ctx, `create schema if not exists `+pq.QuoteIdentifier(schema))
+		if err != nil {
+			return errors.Wrap(err, "error in create schema")
+		}
+		_, err = conn.ExecContext(ctx, `set search_path to `+pq.QuoteIdentifier(schema))
+		if err != nil {
+			return errors.Wrap(err, "error in set search path")
+		}
+		driverCfg.SchemaName = schema
+	}
+
+	driver, err := postgres.WithConnection(ctx, conn, driverCfg)
 	if err != nil {
 		return errors.Wrap(err, "error to define driver")
 	}
-	m, err := migrate.NewWithDatabaseInstance(
-		"file://./migrations",
-		"postgres", driver,
-	)
+	src, err := mg.source()
+	if err != nil {
+		return err
+	}
+	m, err := migrate.NewWithInstance("iofs", src, "postgres", driver)
 	if err != nil {
 		return errors.Wrap(err, "error in create migration client")
 	}
-	err = m.Up()
+	defer func() { _, _ = m.Close() }()
+
+	err = cmd(m)
+	var dirty migrate.ErrDirty
+	if errors.As(err, &dirty) {
+		return &DirtyError{Schema: schema, Version: dirty.Version}
+	}
 	if err != nil && err != migrate.ErrNoChange {
-		downErr := m.Down()
-		if downErr != nil {
-			return errors.Wrap(err, "error in up and down migration")
-		}
-		return errors.Wrap(err, "error in up migration")
+		return errors.Wrap(err, "error in migration")
 	}
 
 	return nil
 }
+
+// withLock calls fn holding session advisory lock of server, so replicas starting at once
+// don't migrate concurrently. Lock is awaited no longer than lock timeout
+func (mg *Migrator) withLock(ctx context.Context, db *sql.DB, fn func() error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error in get lock connection")
+	}
+	defer func() { _ = conn.Close() }()
+
+	deadline := time.Now().Add(mg.lockTimeout)
+	for {
+		var locked bool
+		err = conn.QueryRowContext(ctx, `select pg_try_advisory_lock($1);`, migrationsLockID).Scan(&locked)
+		if err != nil {
+			return errors.Wrap(err, "error in lock migrations")
+		}
+		if locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("migrations are locked by other replica longer than %s", mg.lockTimeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockRetryDelay):
+		}
+	}
+	defer func() {
+		_, _ = conn.ExecContext(context.Background(), `select pg_advisory_unlock($1);`, migrationsLockID)
+	}()
+
+	return fn()
+}
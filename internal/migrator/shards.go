@@ -0,0 +1,178 @@
+package migrator
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/kjushka/microservice-gen/internal/config"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// ShardStatus is migration state of one logical shard schema
+type ShardStatus struct {
+	Server string
+	Schema string
+	// zero if no migrations are applied
+	Version uint
+	Dirty   bool
+}
+
+type ShardsReport struct {
+	// version of the last migration in migrations set
+	Latest uint
+	Shards []ShardStatus
+}
+
+// Behind returns shards which lack some migrations or failed in the middle of one
+func (r ShardsReport) Behind() []ShardStatus {
+	var behind []ShardStatus
+	for _, shard := range r.Shards {
+		if shard.Dirty || shard.Version < r.Latest {
+			behind = append(behind, shard)
+		}
+	}
+	return behind
+}
+
+// MigrateShards applies migrations set to every shard schema, schemas[i] are shard schemas of servers[i].
+// Every shard keeps its version in its own schema_migrations table. Failed shard doesn't stop the others,
+// returned report shows which shards are left behind
+func (mg *Migrator) MigrateShards(ctx context.Context, servers []config.DBServer, schemas [][]string) (ShardsReport, error) {
+	err := mg.RunShards(ctx, servers, schemas, Up(0))
+
+	report, statusErr := mg.ShardsStatus(ctx, servers, schemas)
+	if statusErr != nil {
+		return ShardsReport{}, statusErr
+	}
+
+	return report, err
+}
+
+// RunShards applies command to every shard schema, failed shard doesn't stop the others
+func (mg *Migrator) RunShards(ctx context.Context, servers []config.DBServer, schemas [][]string, cmd Command) error {
+	var failed []string
+	err := forEachServer(servers, func(i int, db *sql.DB) error {
+		return mg.withLock(ctx, db, func() error {
+			for _, schema := range schemas[i] {
+				err := mg.run(ctx, db, schema, cmd)
+				if err != nil {
+					failed = append(failed, fmt.Sprintf("%s on %s: %v", schema, serverAddr(servers[i]), err))
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed migrate shards: %s", strings.Join(failed, "; "))
+	}
+
+	return nil
+}
+
+// CheckClean returns DirtyError of the first dirty shard, service mustn't start while some of shards are dirty
+func (r ShardsReport) CheckClean() error {
+	for _, shard := range r.Shards {
+		if shard.Dirty {
+			return &DirtyError{Schema: shard.Schema, Version: int(shard.Version)}
+		}
+	}
+	return nil
+}
+
+// ShardsStatus reads migration versions of shard schemas without changing them
+func (mg *Migrator) ShardsStatus(ctx context.Context, servers []config.DBServer, schemas [][]string) (ShardsReport, error) {
+	latest, err := mg.latestVersion()
+	if err != nil {
+		return ShardsReport{}, err
+	}
+
+	report := ShardsReport{Latest: latest}
+	err = forEachServer(servers, func(i int, db *sql.DB) error {
+		for _, schema := range schemas[i] {
+			status := ShardStatus{Server: serverAddr(servers[i]), Schema: schema}
+			// version is -1 if the first migration failed
+			var version int64
+			err := db.QueryRowContext(ctx, fmt.Sprintf(
+				`select version, dirty from %s.%s limit 1;`,
+				pq.QuoteIdentifier(schema), pq.QuoteIdentifier(postgres.DefaultMigrationsTable),
+			)).Scan(&version, &status.Dirty)
+			if err != nil && !isUndefinedTable(err) && err != sql.ErrNoRows {
+				return errors.Wrapf(err, "error in read version of %s on %s", schema, status.Server)
+			}
+			if version > 0 {
+				status.Version = uint(version)
+			}
+			report.Shards = append(report.Shards, status)
+		}
+		return nil
+	})
+	if err != nil {
+		return ShardsReport{}, err
+	}
+
+	return report, nil
+}
+
+// forEachServer opens private pool of every server, they are closed after fn
+func forEachServer(servers []config.DBServer, fn func(i int, db *sql.DB) error) error {
+	for i, server := range servers {
+		db, err := sql.Open("postgres", fmt.Sprintf(
+			"postgres://%s:%s@%s/%s?sslmode=disable",
+			server.User,
+			server.Password,
+			serverAddr(server),
+			server.Database,
+		))
+		if err != nil {
+			return errors.Wrapf(err, "couldn't connect with %s", serverAddr(server))
+		}
+
+		err = fn(i, db)
+		_ = db.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func serverAddr(server config.DBServer) string {
+	return fmt.Sprintf("%s:%s", server.Host, server.Port)
+}
+
+// latestVersion returns version of the last migration in migrations set
+func (mg *Migrator) latestVersion() (uint, error) {
+	src, err := mg.source()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = src.Close() }()
+
+	version, err := src.First()
+	if err != nil {
+		return 0, errors.Wrap(err, "error in read first migration")
+	}
+	for {
+		next, err := src.Next(version)
+		if errors.Is(err, os.ErrNotExist) {
+			return version, nil
+		}
+		if err != nil {
+			return 0, errors.Wrap(err, "error in read migrations")
+		}
+		version = next
+	}
+}
+
+func isUndefinedTable(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "42P01"
+}
@@ -2,10 +2,13 @@ package ratelimiter
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/kjushka/microservice-gen/internal/config"
 	"github.com/kjushka/microservice-gen/internal/logger"
+	"github.com/kjushka/microservice-gen/internal/storage/cache"
 	"github.com/mennanov/limiters"
 	"github.com/redis/go-redis/v9"
 	"google.golang.org/grpc"
@@ -13,12 +16,12 @@ import (
 	"google.golang.org/grpc/status"
 )
 
-func UnaryServerInterceptor(redisClient *redis.Client, cfg *config.Config) grpc.UnaryServerInterceptor {
+func UnaryServerInterceptor(redisClient redis.UniversalClient, cfg *config.Config) grpc.UnaryServerInterceptor {
 	rate := time.Second * 3
 	limiter := limiters.NewFixedWindow(
 		cfg.RateLimiterCapacity,
 		rate,
-		limiters.NewFixedWindowRedis(redisClient, "rate-limiting"),
+		newFixedWindowRedis(redisClient, "rate-limiting"),
 		limiters.NewSystemClock(),
 	)
 
@@ -26,11 +29,38 @@ func UnaryServerInterceptor(redisClient *redis.Client, cfg *config.Config) grpc.
 		w, err := limiter.Limit(ctx)
 		if err == limiters.ErrLimitExhausted {
 			return nil, status.Errorf(codes.ResourceExhausted, "try again later in %s", w)
-		} else if err != nil {
+		} else if err != nil && !errors.Is(err, cache.ErrUnavailable) {
 			// The limiter failed. This error should be logged and examined.
+			// Requests aren't limited until redis recovers, storage works without it
 			logger.ErrorKV(ctx, "limiter failed", "error", err)
-			return nil, status.Error(codes.Internal, "internal error")
 		}
 		return handler(ctx, req)
 	}
 }
+
+// fixedWindowRedis is limiters.FixedWindowRedis for every kind of redis client,
+// limiters accepts only single node one
+type fixedWindowRedis struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+func newFixedWindowRedis(client redis.UniversalClient, prefix string) *fixedWindowRedis {
+	return &fixedWindowRedis{client: client, prefix: prefix}
+}
+
+func (f *fixedWindowRedis) Increment(ctx context.Context, window time.Time, ttl time.Duration) (int64, error) {
+	key := fmt.Sprintf("%s/%d", f.prefix, window.UnixNano())
+
+	var incr *redis.IntCmd
+	_, err := f.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, key)
+		pipe.PExpire(ctx, key, ttl)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed increment window: %w", err)
+	}
+
+	return incr.Val(), nil
+}
@@ -6,51 +6,132 @@ import (
 	"fmt"
 	"github.com/kjushka/microservice-gen/internal/closer"
 	"github.com/kjushka/microservice-gen/internal/config"
+	"github.com/kjushka/microservice-gen/internal/logger"
 	"github.com/kjushka/microservice-gen/internal/storage"
 	"github.com/kjushka/microservice-gen/internal/storage/serializer"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/mercari/go-circuitbreaker"
 	"github.com/pkg/errors"
 	"github.com/redis/go-redis/v9"
 	"go.opentelemetry.io/otel/trace"
 )
 
+// Cache isn't source of truth, so it doesn't implement whole storage.Storage
 type Cache interface {
-	storage.Storage
+	// need send pointer to dest. Returns ErrNegativeHit for record known to be missing
+	// and ErrStale with filled dest for value which should be revalidated
+	Get(ctx context.Context, key string, table string, dest any) error
+	// need send pointer to dest. Reads all keys in one round trip and returns lookup result of every key,
+	// dest is filled for LookupHit and LookupStale
+	GetMany(ctx context.Context, keys []string, table string, dest ...any) ([]Lookup, error)
+	// record ttl from opts is used if it is less than default cache expiration time, tags from opts are
+	// remembered for invalidation
+	Save(ctx context.Context, key string, data any, table string, opts ...storage.SaveOption) error
+	// Populate sets already encoded data only if key is missing, so newer saved value isn't overwritten.
+	// Zero ttl means default cache expiration time
+	Populate(ctx context.Context, key string, table string, data []byte, ttl time.Duration) error
+	// Refresh sets encoded data only if key still holds stale value
+	Refresh(ctx context.Context, key string, table string, data []byte, ttl time.Duration) error
+	// SaveNotFound remembers that record is missing for negative ttl, it doesn't overwrite existing value
+	SaveNotFound(ctx context.Context, key string, table string) error
+	Delete(ctx context.Context, key string, table string) error
 
-	RedisClient() *redis.Client
+	// SaveBehind sets encoded data and queues it for flushing to database in one transaction
+	SaveBehind(ctx context.Context, key string, table string, data []byte, opts ...storage.SaveOption) error
+	// DeleteBehind removes record and queues its removal from database in one transaction
+	DeleteBehind(ctx context.Context, key string, table string) error
+	// AcquireBehindLease takes or extends lease of the only flusher for ttl, it reports whether consumer holds it
+	AcquireBehindLease(ctx context.Context, consumer string, ttl time.Duration) (bool, error)
+	// ReleaseBehindLease gives lease up if consumer holds it
+	ReleaseBehindLease(ctx context.Context, consumer string) error
+	// ReadBehind returns up to count queued writes for consumer: its own not acknowledged writes,
+	// then writes of previous lease holders, then new ones waiting for them up to block.
+	// Only lease holder may call it
+	ReadBehind(ctx context.Context, consumer string, count int64, block time.Duration) ([]QueuedWrite, error)
+	// AckBehind removes flushed writes from queue
+	AckBehind(ctx context.Context, ids ...string) error
+	// DeadLetterBehind removes write which can't be flushed from queue and keeps it in dead letter stream
+	DeadLetterBehind(ctx context.Context, write QueuedWrite, reason error) error
+
+	// Tag remembers tags of key which value isn't cached by write
+	Tag(ctx context.Context, key string, table string, tags ...string) error
+	storage.Invalidator
+
+	RedisClient() redis.UniversalClient
+	// Degraded reports that redis is unavailable, every call fails with ErrUnavailable until it recovers
+	Degraded() bool
+	// OnDegradedChange calls fn every time cache becomes degraded or recovers
+	OnDegradedChange(fn func(degraded bool))
 }
 
 func InitCache(cfg *config.Config, tracer trace.Tracer) (Cache, error) {
+	s, err := serializer.Init(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed create serializer")
+	}
+
+	redisClient, err := newRedisClient(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed create redis client")
+	}
+
 	rdb := &cache{
-		redisClient: redis.NewClient(&redis.Options{
-			Addr:     fmt.Sprintf("redis:%s", cfg.CachePort),
-			Password: "",
-			DB:       0,
-		}),
-		serializer: serializer.NewMessagePackSerializer(),
-		expireTime: cfg.CacheExpirationTime,
-		tracer:     tracer,
+		redisClient: redisClient,
+		serializer:  s,
+		expireTime:  cfg.CacheExpirationTime,
+		softTTL:     cfg.CacheSoftTTL,
+		negativeTTL: cfg.CacheNegativeTTL,
+		tracer:      tracer,
+		missed:      missedInvalidations{keys: make(map[string]struct{})},
 	}
 
+	ctx := logger.WithName(context.Background(), "cache")
+	rdb.breaker = newBreaker(ctx, rdb.setDegraded)
+	rdb.redisClient.AddHook(breakerHook{cb: rdb.breaker})
 	closer.Add(rdb.redisClient.Close)
 
-	_, err := rdb.redisClient.Ping(context.Background()).Result()
+	// service works with database only until redis is available
+	_, err = rdb.redisClient.Ping(ctx).Result()
 	if err != nil {
-		return nil, errors.Wrap(err, "error in ping redis")
+		logger.ErrorKV(ctx, "error in ping redis, cache is degraded", "error", err)
+		rdb.breaker.SetState(circuitbreaker.StateOpen)
+	}
+	go rdb.replayMissed(ctx)
+
+	if cfg.CacheL1Size > 0 {
+		rdb.l1 = newL1(cfg.CacheL1Size)
+		ctx := logger.WithName(context.Background(), "cache invalidation")
+		pubsub := rdb.redisClient.Subscribe(ctx, invalidationChannel)
+		closer.Add(pubsub.Close)
+		go rdb.listenInvalidation(ctx, pubsub)
 	}
 
 	return rdb, nil
 }
 
 type cache struct {
-	redisClient *redis.Client
-	serializer  *serializer.MessagePackSerializer
+	redisClient redis.UniversalClient
+	serializer  serializer.Serializer
 	expireTime  time.Duration
+	softTTL     time.Duration // zero if stale values aren't served
+	negativeTTL time.Duration // zero if missing records aren't cached
 	tracer      trace.Tracer
+
+	behindGroupCreated atomic.Bool
+	// nil if local cache is disabled
+	l1 *l1
+
+	breaker       *circuitbreaker.CircuitBreaker
+	degraded      atomic.Bool
+	degradedMu    sync.Mutex
+	degradedHooks []func(degraded bool)
+	missed        missedInvalidations
 }
 
-func (c *cache) RedisClient() *redis.Client {
+func (c *cache) RedisClient() redis.UniversalClient {
 	return c.redisClient
 }
 
@@ -59,9 +140,14 @@ func (c *cache) Get(ctx context.Context, key string, table string, dest any) err
 	defer span.End()
 
 	key = fmt.Sprintf("%s-%s", key, table)
-	encoded, err := c.redisClient.Get(ctx, key).Bytes()
+	raw, err := c.get(ctx, key)
 	if err != nil {
-		return fmt.Errorf("failed get from redis: %v", err)
+		return err
+	}
+
+	encoded, state := unwrap(raw)
+	if state == entryNegative {
+		return ErrNegativeHit
 	}
 
 	err = c.serializer.Decode(bytes.NewReader(encoded), dest)
@@ -69,29 +155,161 @@ func (c *cache) Get(ctx context.Context, key string, table string, dest any) err
 		return fmt.Errorf("failed decoding: %v", err)
 	}
 
+	if state == entryStale {
+		return ErrStale
+	}
 	return nil
 }
 
-func (c *cache) GetMany(ctx context.Context, keys []string, table string, dest ...any) error {
+// get reads encoded value from local cache, then from redis
+func (c *cache) get(ctx context.Context, key string) ([]byte, error) {
+	if c.l1 == nil {
+		encoded, err := c.redisClient.Get(ctx, key).Bytes()
+		if errors.Is(err, redis.Nil) {
+			return nil, storage.ErrNotFound
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed get from redis: %w", err)
+		}
+		return encoded, nil
+	}
+
+	if encoded, ok := c.l1.get(key); ok {
+		return encoded, nil
+	}
+
+	// local entry must not outlive redis one
+	generation := c.l1.currentGeneration()
+	var (
+		getCmd  *redis.StringCmd
+		pttlCmd *redis.DurationCmd
+	)
+	_, err := c.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		getCmd = pipe.Get(ctx, key)
+		pttlCmd = pipe.PTTL(ctx, key)
+		return nil
+	})
+	if errors.Is(err, redis.Nil) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed get from redis: %w", err)
+	}
+	encoded, _ := getCmd.Bytes()
+	c.l1.set(key, encoded, pttlCmd.Val(), generation)
+
+	return encoded, nil
+}
+
+func (c *cache) GetMany(ctx context.Context, keys []string, table string, dest ...any) ([]Lookup, error) {
 	ctx, span := c.tracer.Start(ctx, "get many from db")
 	defer span.End()
 
 	if len(keys) != len(dest) {
-		return errors.New("len of keys not equal len of dest")
+		return nil, errors.New("len of keys not equal len of dest")
 	}
 
-	var err error
+	fullKeys := make([]string, len(keys))
 	for i, key := range keys {
-		err = c.Get(ctx, key, table, dest[i])
+		fullKeys[i] = fmt.Sprintf("%s-%s", key, table)
+	}
+	raws, err := c.getMany(ctx, fullKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	lookups := make([]Lookup, len(keys))
+	for i, raw := range raws {
+		if raw == nil {
+			lookups[i] = LookupMiss
+			continue
+		}
+
+		encoded, state := unwrap(raw)
+		if state == entryNegative {
+			lookups[i] = LookupNegative
+			continue
+		}
+		err = c.serializer.Decode(bytes.NewReader(encoded), dest[i])
 		if err != nil {
-			return fmt.Errorf("failed get item with key '%s': %v", key, err)
+			return nil, fmt.Errorf("failed decoding item with key '%s': %v", keys[i], err)
+		}
+		lookups[i] = LookupHit
+		if state == entryStale {
+			lookups[i] = LookupStale
 		}
 	}
 
-	return nil
+	return lookups, nil
+}
+
+// getMany reads encoded values from local cache, then the rest from redis in one round trip
+// (one per node in cluster). Value of missing key is nil
+func (c *cache) getMany(ctx context.Context, keys []string) ([][]byte, error) {
+	raws := make([][]byte, len(keys))
+	// keys of one MGET must belong to one slot in cluster
+	if _, cluster := c.redisClient.(*redis.ClusterClient); c.l1 == nil && !cluster {
+		values, err := c.redisClient.MGet(ctx, keys...).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed get from redis: %w", err)
+		}
+		for i, v := range values {
+			if encoded, ok := v.(string); ok {
+				raws[i] = []byte(encoded)
+			}
+		}
+		return raws, nil
+	}
+
+	var missed []int
+	for i, key := range keys {
+		if c.l1 != nil {
+			if encoded, ok := c.l1.get(key); ok {
+				raws[i] = encoded
+				continue
+			}
+		}
+		missed = append(missed, i)
+	}
+	if len(missed) == 0 {
+		return raws, nil
+	}
+
+	// local entries must not outlive redis ones
+	var generation uint64
+	if c.l1 != nil {
+		generation = c.l1.currentGeneration()
+	}
+	getCmds := make([]*redis.StringCmd, len(missed))
+	pttlCmds := make([]*redis.DurationCmd, len(missed))
+	_, err := c.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for j, i := range missed {
+			getCmds[j] = pipe.Get(ctx, keys[i])
+			if c.l1 != nil {
+				pttlCmds[j] = pipe.PTTL(ctx, keys[i])
+			}
+		}
+		return nil
+	})
+	// redis.Nil of any missing key is returned as pipeline error
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("failed get from redis: %w", err)
+	}
+	for j, i := range missed {
+		encoded, err := getCmds[j].Bytes()
+		if err != nil {
+			continue
+		}
+		raws[i] = encoded
+		if c.l1 != nil {
+			c.l1.set(keys[i], encoded, pttlCmds[j].Val(), generation)
+		}
+	}
+
+	return raws, nil
 }
 
-func (c *cache) Save(ctx context.Context, key string, data any, table string) error {
+func (c *cache) Save(ctx context.Context, key string, data any, table string, opts ...storage.SaveOption) error {
 	ctx, span := c.tracer.Start(ctx, "save to db")
 	defer span.End()
 
@@ -103,14 +321,101 @@ func (c *cache) Save(ctx context.Context, key string, data any, table string) er
 		return fmt.Errorf("failed encode data: %v", err)
 	}
 
-	err = c.redisClient.Set(ctx, key, buf.Bytes(), c.expireTime).Err()
+	o := storage.NewSaveOptions(opts...)
+	_, err = c.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, key, c.wrap(buf.Bytes(), o.TTL), c.ttl(o.TTL))
+		c.track(ctx, pipe, key, table, o.Tags)
+		return nil
+	})
+	if err != nil {
+		c.writeFailed(key, err)
+		return fmt.Errorf("failed set data to redis: %w", err)
+	}
+	c.invalidate(ctx, key)
+
+	return nil
+}
+
+func (c *cache) Populate(ctx context.Context, key string, table string, data []byte, ttl time.Duration) error {
+	ctx, span := c.tracer.Start(ctx, "populate cache")
+	defer span.End()
+
+	key = fmt.Sprintf("%s-%s", key, table)
+	_, err := c.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SetNX(ctx, key, c.wrap(data, ttl), c.ttl(ttl))
+		c.track(ctx, pipe, key, table, nil)
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed set data to redis: %v", err)
+		return fmt.Errorf("failed set data to redis: %w", err)
 	}
 
 	return nil
 }
 
+func (c *cache) Refresh(ctx context.Context, key string, table string, data []byte, ttl time.Duration) error {
+	ctx, span := c.tracer.Start(ctx, "refresh cache")
+	defer span.End()
+
+	key = fmt.Sprintf("%s-%s", key, table)
+	err := c.redisClient.Watch(ctx, func(tx *redis.Tx) error {
+		raw, err := tx.Get(ctx, key).Bytes()
+		// value was saved or removed concurrently
+		if errors.Is(err, redis.Nil) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, state := unwrap(raw); state != entryStale {
+			return nil
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, c.wrap(data, ttl), c.ttl(ttl))
+			return nil
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed refresh data in redis: %w", err)
+	}
+	c.invalidate(ctx, key)
+
+	return nil
+}
+
+func (c *cache) SaveNotFound(ctx context.Context, key string, table string) error {
+	if c.negativeTTL <= 0 {
+		return nil
+	}
+	ctx, span := c.tracer.Start(ctx, "save not found to cache")
+	defer span.End()
+
+	key = fmt.Sprintf("%s-%s", key, table)
+	_, err := c.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SetNX(ctx, key, []byte{serializer.HeaderMagic, negativeEnvelopeFlag}, c.negativeTTL)
+		c.track(ctx, pipe, key, table, nil)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed set not found to redis: %w", err)
+	}
+
+	return nil
+}
+
+// ttl returns record ttl if it is less than default expiration time
+func (c *cache) ttl(recordTTL time.Duration) time.Duration {
+	if recordTTL > 0 && recordTTL < c.expireTime {
+		return recordTTL
+	}
+	return c.expireTime
+}
+
 func (c *cache) Delete(ctx context.Context, key string, table string) error {
 	ctx, span := c.tracer.Start(ctx, "delete in db")
 	defer span.End()
@@ -118,8 +423,10 @@ func (c *cache) Delete(ctx context.Context, key string, table string) error {
 	key = fmt.Sprintf("%s-%s", key, table)
 	err := c.redisClient.Del(ctx, key).Err()
 	if err != nil {
-		return fmt.Errorf("failed remove from redis: %v", err)
+		c.writeFailed(key, err)
+		return fmt.Errorf("failed remove from redis: %w", err)
 	}
+	c.invalidate(ctx, key)
 
 	return nil
 }
@@ -0,0 +1,237 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kjushka/microservice-gen/internal/storage"
+	"github.com/kjushka/microservice-gen/internal/storage/serializer"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var errRedisDown = errors.New("connection refused")
+
+// fakeRedis serves commands from memory instead of redis server, commands not used by tests fail
+type fakeRedis struct {
+	mu        sync.Mutex
+	values    map[string]string
+	sets      map[string]map[string]struct{}
+	published []string
+	// down fails every command like unavailable server
+	down bool
+	// onScan is called before set is scanned
+	onScan func()
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{values: make(map[string]string), sets: make(map[string]map[string]struct{})}
+}
+
+func (f *fakeRedis) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (f *fakeRedis) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		return f.process(cmd)
+	}
+}
+
+func (f *fakeRedis) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		var firstErr error
+		for _, cmd := range cmds {
+			if err := f.process(cmd); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+}
+
+func (f *fakeRedis) process(cmd redis.Cmder) error {
+	if cmd.Name() == "sscan" {
+		if onScan := f.onScan; onScan != nil {
+			f.onScan = nil
+			onScan()
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		cmd.SetErr(errRedisDown)
+		return errRedisDown
+	}
+
+	args := cmd.Args()
+	arg := func(i int) string {
+		return fmt.Sprint(args[i])
+	}
+	switch cmd := cmd.(type) {
+	case *redis.StringCmd:
+		value, ok := f.values[arg(1)]
+		if !ok {
+			cmd.SetErr(redis.Nil)
+			return redis.Nil
+		}
+		cmd.SetVal(value)
+	case *redis.StatusCmd:
+		switch cmd.Name() {
+		case "set":
+			f.values[arg(1)] = toString(args[2])
+		case "rename":
+			set, ok := f.sets[arg(1)]
+			if !ok {
+				err := errors.New("ERR no such key")
+				cmd.SetErr(err)
+				return err
+			}
+			delete(f.sets, arg(1))
+			f.sets[arg(2)] = set
+		default:
+			return f.unsupported(cmd)
+		}
+		cmd.SetVal("OK")
+	case *redis.BoolCmd:
+		switch cmd.Name() {
+		case "set", "setnx":
+			_, exists := f.values[arg(1)]
+			if !exists {
+				f.values[arg(1)] = toString(args[2])
+			}
+			cmd.SetVal(!exists)
+		case "expire", "pexpire":
+			cmd.SetVal(true)
+		default:
+			return f.unsupported(cmd)
+		}
+	case *redis.IntCmd:
+		switch cmd.Name() {
+		case "del":
+			var n int64
+			for i := 1; i < len(args); i++ {
+				_, value := f.values[arg(i)]
+				_, set := f.sets[arg(i)]
+				if value || set {
+					n++
+				}
+				delete(f.values, arg(i))
+				delete(f.sets, arg(i))
+			}
+			cmd.SetVal(n)
+		case "sadd":
+			set, ok := f.sets[arg(1)]
+			if !ok {
+				set = make(map[string]struct{})
+				f.sets[arg(1)] = set
+			}
+			for i := 2; i < len(args); i++ {
+				set[arg(i)] = struct{}{}
+			}
+		case "publish":
+			f.published = append(f.published, arg(2))
+		default:
+			return f.unsupported(cmd)
+		}
+	case *redis.DurationCmd:
+		cmd.SetVal(time.Hour)
+	case *redis.ScanCmd:
+		members := make([]string, 0, len(f.sets[arg(1)]))
+		for member := range f.sets[arg(1)] {
+			members = append(members, member)
+		}
+		cmd.SetVal(members, 0)
+	default:
+		return f.unsupported(cmd)
+	}
+	return nil
+}
+
+func (f *fakeRedis) unsupported(cmd redis.Cmder) error {
+	err := fmt.Errorf("command '%s' isn't supported by fake redis", cmd.Name())
+	cmd.SetErr(err)
+	return err
+}
+
+func toString(value any) string {
+	if b, ok := value.([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprint(value)
+}
+
+func (f *fakeRedis) has(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.values[key]
+	return ok
+}
+
+func (f *fakeRedis) set(key string, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.values[key] = value
+}
+
+func (f *fakeRedis) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+// newTestCache returns cache backed by fake redis, l1 is enabled if l1Size is positive
+func newTestCache(t *testing.T, l1Size int64, hooks ...redis.Hook) (*cache, *fakeRedis) {
+	t.Helper()
+	f := newFakeRedis()
+	client := redis.NewClient(&redis.Options{Addr: "fake:6379"})
+	t.Cleanup(func() { _ = client.Close() })
+	for _, hook := range hooks {
+		client.AddHook(hook)
+	}
+	client.AddHook(f)
+
+	s, err := serializer.New(serializer.JSONSerializerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &cache{
+		redisClient: client,
+		serializer:  s,
+		expireTime:  time.Hour,
+		tracer:      trace.NewNoopTracerProvider().Tracer("test"),
+		missed:      missedInvalidations{keys: make(map[string]struct{})},
+	}
+	if l1Size > 0 {
+		c.l1 = newL1(l1Size)
+	}
+	return c, f
+}
+
+func mustGet(t *testing.T, c *cache, key string, table string) string {
+	t.Helper()
+	var value string
+	err := c.Get(context.Background(), key, table, &value)
+	if err != nil {
+		t.Fatalf("get '%s': %v", key, err)
+	}
+	return value
+}
+
+func mustSave(t *testing.T, c *cache, key string, value string, table string, opts ...storage.SaveOption) {
+	t.Helper()
+	err := c.Save(context.Background(), key, value, table, opts...)
+	if err != nil {
+		t.Fatalf("save '%s': %v", key, err)
+	}
+}
+
+// cacheKey is redis key of record
+func cacheKey(key string, table string) string {
+	return fmt.Sprintf("%s-%s", key, table)
+}
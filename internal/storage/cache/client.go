@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/kjushka/microservice-gen/internal/config"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	ModeStandalone = "standalone"
+	ModeSentinel   = "sentinel"
+	ModeCluster    = "cluster"
+)
+
+// newRedisClient creates client of configured mode, every mode is used through redis.UniversalClient
+func newRedisClient(cfg *config.Config) (redis.UniversalClient, error) {
+	opts := &redis.UniversalOptions{
+		Addrs:        cfg.CacheAddrs,
+		DB:           cfg.CacheDB,
+		Username:     cfg.CacheUsername,
+		Password:     cfg.CachePassword,
+		MasterName:   cfg.CacheMasterName,
+		DialTimeout:  cfg.CacheTimeout,
+		ReadTimeout:  cfg.CacheTimeout,
+		WriteTimeout: cfg.CacheTimeout,
+	}
+
+	if cfg.CacheTLS {
+		tlsConfig, err := redisTLSConfig(cfg.CacheTLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		opts.TLSConfig = tlsConfig
+	}
+
+	switch cfg.CacheMode {
+	case ModeStandalone:
+		if len(opts.Addrs) != 1 {
+			return nil, fmt.Errorf("standalone mode needs one address, got %d", len(opts.Addrs))
+		}
+		return redis.NewClient(opts.Simple()), nil
+	case ModeSentinel:
+		if opts.MasterName == "" {
+			return nil, errors.New("sentinel mode needs master name")
+		}
+		// addresses are sentinels, username and password are used for master and replicas
+		return redis.NewFailoverClient(opts.Failover()), nil
+	case ModeCluster:
+		if opts.DB != 0 {
+			return nil, errors.New("cluster mode supports only db 0")
+		}
+		return redis.NewClusterClient(opts.Cluster()), nil
+	default:
+		return nil, fmt.Errorf("unknown redis mode '%s'", cfg.CacheMode)
+	}
+}
+
+// redisTLSConfig trusts certificates from caFile, system roots are used for empty caFile
+func redisTLSConfig(caFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed read ca file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in ca file '%s'", caFile)
+	}
+	tlsConfig.RootCAs = pool
+
+	return tlsConfig, nil
+}
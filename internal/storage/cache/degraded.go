@@ -0,0 +1,181 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/cenkalti/backoff/v3"
+	"github.com/kjushka/microservice-gen/internal/logger"
+	"github.com/mercari/go-circuitbreaker"
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrUnavailable is returned without calling redis while cache is degraded
+var ErrUnavailable = errors.New("cache is unavailable")
+
+const (
+	breakerConsecutiveFailures = 5
+	// invalidations missed while redis was unavailable are kept up to this count,
+	// other keys may stay stale in redis until they expire
+	maxMissedInvalidations = 100000
+	missedReplayInterval   = time.Second
+	missedReplayBatch      = 1000
+)
+
+func newBreaker(ctx context.Context, onChange func(degraded bool)) *circuitbreaker.CircuitBreaker {
+	return circuitbreaker.New(
+		circuitbreaker.WithClock(clock.New()),
+		circuitbreaker.WithHalfOpenMaxSuccesses(10),
+		circuitbreaker.WithOpenTimeoutBackOff(backoff.NewExponentialBackOff()),
+		circuitbreaker.WithOpenTimeout(10*time.Second),
+		circuitbreaker.WithCounterResetInterval(10*time.Second),
+		circuitbreaker.WithTripFunc(circuitbreaker.NewTripFuncConsecutiveFailures(breakerConsecutiveFailures)),
+		circuitbreaker.WithOnStateChangeHookFn(func(from, to circuitbreaker.State) {
+			logger.InfoKV(ctx, "cache circuit breaker state changed", "from", from, "to", to)
+			onChange(to != circuitbreaker.StateClosed)
+		}),
+	)
+}
+
+// breakerHook counts failures of every redis command and fails fast while breaker is open.
+// Error reply means that redis is alive, so it isn't a failure
+type breakerHook struct {
+	cb *circuitbreaker.CircuitBreaker
+}
+
+func (h breakerHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h breakerHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if !h.cb.Ready() {
+			cmd.SetErr(ErrUnavailable)
+			return ErrUnavailable
+		}
+		err := next(ctx, cmd)
+		_ = h.cb.Done(ctx, breakerError(err))
+		return err
+	}
+}
+
+func (h breakerHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if !h.cb.Ready() {
+			for _, cmd := range cmds {
+				cmd.SetErr(ErrUnavailable)
+			}
+			return ErrUnavailable
+		}
+		err := next(ctx, cmds)
+		_ = h.cb.Done(ctx, breakerError(err))
+		return err
+	}
+}
+
+func breakerError(err error) error {
+	var redisErr redis.Error
+	if err == nil || errors.As(err, &redisErr) {
+		return nil
+	}
+	return err
+}
+
+func (c *cache) Degraded() bool {
+	return c.degraded.Load()
+}
+
+func (c *cache) OnDegradedChange(fn func(degraded bool)) {
+	c.degradedMu.Lock()
+	defer c.degradedMu.Unlock()
+	c.degradedHooks = append(c.degradedHooks, fn)
+}
+
+func (c *cache) setDegraded(degraded bool) {
+	if c.degraded.Swap(degraded) == degraded {
+		return
+	}
+	c.degradedMu.Lock()
+	defer c.degradedMu.Unlock()
+	for _, fn := range c.degradedHooks {
+		fn(degraded)
+	}
+}
+
+// missedInvalidations are keys which could keep stale value in redis after failed write
+type missedInvalidations struct {
+	mu       sync.Mutex
+	keys     map[string]struct{}
+	overflow bool
+}
+
+func (m *missedInvalidations) add(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.keys) >= maxMissedInvalidations {
+		m.overflow = true
+		return
+	}
+	m.keys[key] = struct{}{}
+}
+
+func (m *missedInvalidations) take(count int) (keys []string, overflow bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.keys {
+		if len(keys) == count {
+			break
+		}
+		keys = append(keys, key)
+		delete(m.keys, key)
+	}
+	overflow, m.overflow = m.overflow, false
+	return keys, overflow
+}
+
+// writeFailed remembers key which write failed, so its value is removed from redis after recovery
+func (c *cache) writeFailed(key string, err error) {
+	if err != nil {
+		c.missed.add(key)
+	}
+}
+
+// replayMissed removes keys with missed invalidations from redis while it is available
+func (c *cache) replayMissed(ctx context.Context) {
+	ticker := time.NewTicker(missedReplayInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if c.Degraded() {
+			continue
+		}
+		c.replayBatch(ctx)
+	}
+}
+
+// replayBatch removes batch of keys with missed invalidations, keys failed to remove are kept for next batch
+func (c *cache) replayBatch(ctx context.Context) {
+	keys, overflow := c.missed.take(missedReplayBatch)
+	if overflow {
+		logger.WarnKV(ctx, "too many invalidations were missed, cache may return stale values until they expire")
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	err := c.del(ctx, keys)
+	if err != nil {
+		for _, key := range keys {
+			c.missed.add(key)
+		}
+		return
+	}
+	if c.l1 != nil {
+		for _, key := range keys {
+			c.invalidate(ctx, key)
+		}
+	}
+}
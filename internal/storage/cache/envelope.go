@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kjushka/microservice-gen/internal/storage"
+	"github.com/kjushka/microservice-gen/internal/storage/serializer"
+)
+
+// envelope keeps soft expiration time before encoded value, negative entry is envelope without value
+const (
+	envelopeFlag         byte = 0x30
+	negativeEnvelopeFlag byte = 0x31
+	envelopeSize              = 2 + 8
+)
+
+// ErrNegativeHit means that record is known to be missing, it matches storage.ErrNotFound
+var ErrNegativeHit = fmt.Errorf("negative cache hit: %w", storage.ErrNotFound)
+
+// ErrStale is returned with decoded value when its soft ttl is expired, value should be revalidated
+var ErrStale = errors.New("stale cache value")
+
+// Lookup is result of reading one key by GetMany
+type Lookup int8
+
+const (
+	LookupMiss Lookup = iota
+	LookupHit
+	// value should be revalidated
+	LookupStale
+	// record is known to be missing
+	LookupNegative
+)
+
+type entryState int
+
+const (
+	entryFresh entryState = iota
+	entryStale
+	entryNegative
+)
+
+// wrap adds soft expiration time to encoded value, value isn't wrapped if stale values aren't served
+func (c *cache) wrap(data []byte, ttl time.Duration) []byte {
+	if c.softTTL <= 0 {
+		return data
+	}
+	softTTL := c.softTTL
+	if hardTTL := c.ttl(ttl); hardTTL < softTTL {
+		softTTL = hardTTL
+	}
+
+	wrapped := make([]byte, envelopeSize, envelopeSize+len(data))
+	wrapped[0], wrapped[1] = serializer.HeaderMagic, envelopeFlag
+	binary.BigEndian.PutUint64(wrapped[2:], uint64(time.Now().Add(softTTL).UnixMilli()))
+	return append(wrapped, data...)
+}
+
+// unwrap returns encoded value and its state, value without envelope is fresh
+func unwrap(raw []byte) ([]byte, entryState) {
+	if len(raw) < 2 || raw[0] != serializer.HeaderMagic {
+		return raw, entryFresh
+	}
+	switch raw[1] {
+	case negativeEnvelopeFlag:
+		return nil, entryNegative
+	case envelopeFlag:
+		if len(raw) < envelopeSize {
+			return raw, entryFresh
+		}
+		softExpiresAt := time.UnixMilli(int64(binary.BigEndian.Uint64(raw[2:])))
+		if time.Now().After(softExpiresAt) {
+			return raw[envelopeSize:], entryStale
+		}
+		return raw[envelopeSize:], entryFresh
+	default:
+		return raw, entryFresh
+	}
+}
@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/kjushka/microservice-gen/internal/storage/serializer"
+)
+
+func TestEnvelope(t *testing.T) {
+	encoded := []byte{serializer.HeaderMagic, 0x02, '"', 'v', '"'}
+
+	t.Run("fresh value", func(t *testing.T) {
+		c := &cache{expireTime: time.Hour, softTTL: time.Minute}
+		data, state := unwrap(c.wrap(encoded, 0))
+		if state != entryFresh || !bytes.Equal(data, encoded) {
+			t.Fatalf("unwrapped %x in state %v, want fresh %x", data, state, encoded)
+		}
+	})
+
+	t.Run("stale value", func(t *testing.T) {
+		c := &cache{expireTime: time.Hour, softTTL: time.Millisecond}
+		wrapped := c.wrap(encoded, 0)
+		time.Sleep(5 * time.Millisecond)
+		data, state := unwrap(wrapped)
+		if state != entryStale || !bytes.Equal(data, encoded) {
+			t.Fatalf("unwrapped %x in state %v, want stale %x", data, state, encoded)
+		}
+	})
+
+	t.Run("soft ttl is limited by record ttl", func(t *testing.T) {
+		c := &cache{expireTime: time.Hour, softTTL: time.Minute}
+		before := time.Now()
+		wrapped := c.wrap(encoded, time.Second)
+		softExpiresAt := time.UnixMilli(int64(binary.BigEndian.Uint64(wrapped[2:envelopeSize])))
+		if softExpiresAt.After(before.Add(time.Second + time.Millisecond)) {
+			t.Fatalf("soft expiration is %v, want not later than record expiration", softExpiresAt.Sub(before))
+		}
+	})
+
+	t.Run("value isn't wrapped without soft ttl", func(t *testing.T) {
+		c := &cache{expireTime: time.Hour}
+		wrapped := c.wrap(encoded, 0)
+		if !bytes.Equal(wrapped, encoded) {
+			t.Fatalf("wrapped %x, want %x", wrapped, encoded)
+		}
+		data, state := unwrap(wrapped)
+		if state != entryFresh || !bytes.Equal(data, encoded) {
+			t.Fatalf("unwrapped %x in state %v, want fresh %x", data, state, encoded)
+		}
+	})
+
+	t.Run("negative entry", func(t *testing.T) {
+		data, state := unwrap([]byte{serializer.HeaderMagic, negativeEnvelopeFlag})
+		if state != entryNegative || data != nil {
+			t.Fatalf("unwrapped %x in state %v, want negative entry", data, state)
+		}
+	})
+
+	t.Run("headerless value is fresh", func(t *testing.T) {
+		legacy := []byte{0x92, 0xa1, 'v', 0x01}
+		data, state := unwrap(legacy)
+		if state != entryFresh || !bytes.Equal(data, legacy) {
+			t.Fatalf("unwrapped %x in state %v, want fresh %x", data, state, legacy)
+		}
+	})
+
+	t.Run("truncated envelope is kept as is", func(t *testing.T) {
+		truncated := []byte{serializer.HeaderMagic, envelopeFlag, 0x01}
+		data, state := unwrap(truncated)
+		if state != entryFresh || !bytes.Equal(data, truncated) {
+			t.Fatalf("unwrapped %x in state %v, want fresh %x", data, state, truncated)
+		}
+	})
+}
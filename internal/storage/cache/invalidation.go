@@ -0,0 +1,145 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const invalidationBatch = 1000
+
+// sets keep keys ever cached for table or tag. Hash tag keeps set in one slot in cluster
+func tableSetKey(table string) string {
+	return fmt.Sprintf("cache-table:{%s}", table)
+}
+
+func tagSetKey(tag string) string {
+	return fmt.Sprintf("cache-tag:{%s}", tag)
+}
+
+// track adds cached key to sets of its table and tags in the same pipeline as the write.
+// Ttl of set is extended by every write, so set outlives all values it tracks. Value loaded
+// from database doesn't know its tags, it is tracked by table set only
+func (c *cache) track(ctx context.Context, pipe redis.Pipeliner, key string, table string, tags []string) {
+	tableSet := tableSetKey(table)
+	pipe.SAdd(ctx, tableSet, key)
+	pipe.Expire(ctx, tableSet, c.setTTL())
+	for _, tag := range tags {
+		tagSet := tagSetKey(tag)
+		pipe.SAdd(ctx, tagSet, key)
+		pipe.Expire(ctx, tagSet, c.setTTL())
+	}
+}
+
+func (c *cache) Tag(ctx context.Context, key string, table string, tags ...string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	ctx, span := c.tracer.Start(ctx, "tag in cache")
+	defer span.End()
+
+	key = fmt.Sprintf("%s-%s", key, table)
+	_, err := c.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, tag := range tags {
+			tagSet := tagSetKey(tag)
+			pipe.SAdd(ctx, tagSet, key)
+			pipe.Expire(ctx, tagSet, c.setTTL())
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed tag key in redis: %w", err)
+	}
+	return nil
+}
+
+// setTTL is the longest ttl of value, negative one included
+func (c *cache) setTTL() time.Duration {
+	if c.negativeTTL > c.expireTime {
+		return c.negativeTTL
+	}
+	return c.expireTime
+}
+
+func (c *cache) InvalidateTag(ctx context.Context, tag string) error {
+	ctx, span := c.tracer.Start(ctx, "invalidate tag in cache")
+	defer span.End()
+
+	err := c.invalidateSet(ctx, tagSetKey(tag))
+	if err != nil {
+		return fmt.Errorf("failed invalidate tag '%s': %w", tag, err)
+	}
+	return nil
+}
+
+func (c *cache) InvalidateTable(ctx context.Context, table string) error {
+	ctx, span := c.tracer.Start(ctx, "invalidate table in cache")
+	defer span.End()
+
+	err := c.invalidateSet(ctx, tableSetKey(table))
+	if err != nil {
+		return fmt.Errorf("failed invalidate table '%s': %w", table, err)
+	}
+	return nil
+}
+
+// invalidateSet removes every key of set from redis and purges local caches of all instances, set is removed too.
+// Set is renamed first, so keys cached meanwhile go to new set and aren't lost with removed one.
+// Renamed set keeps ttl, it expires by itself if invalidation fails.
+// Values cached concurrently may survive, they are loaded after database was changed anyway
+func (c *cache) invalidateSet(ctx context.Context, setKey string) error {
+	// hash tag of set key keeps renamed set in the same slot
+	renamed := fmt.Sprintf("%s:invalidating:%d", setKey, time.Now().UnixNano())
+	err := c.redisClient.Rename(ctx, setKey, renamed).Err()
+	if err != nil && strings.Contains(err.Error(), "no such key") {
+		c.invalidateAll(ctx)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed rename set: %w", err)
+	}
+
+	keys := make([]string, 0, invalidationBatch)
+	iter := c.redisClient.SScan(ctx, renamed, 0, "", invalidationBatch).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) < invalidationBatch {
+			continue
+		}
+		err := c.del(ctx, keys)
+		if err != nil {
+			return err
+		}
+		keys = keys[:0]
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("failed scan keys: %w", err)
+	}
+	err = c.del(ctx, append(keys, renamed))
+	if err != nil {
+		return err
+	}
+
+	c.invalidateAll(ctx)
+	return nil
+}
+
+// del removes keys one by one in pipeline, keys may belong to different slots in cluster
+func (c *cache) del(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := c.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Del(ctx, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed remove from redis: %w", err)
+	}
+	return nil
+}
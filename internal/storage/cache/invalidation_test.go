@@ -0,0 +1,230 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/kjushka/microservice-gen/internal/storage"
+	"github.com/mercari/go-circuitbreaker"
+)
+
+func (f *fakeRedis) setKeys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]string, 0, len(f.sets))
+	for key := range f.sets {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (f *fakeRedis) inSet(setKey string, key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.sets[setKey][key]
+	return ok
+}
+
+func TestInvalidate(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("table drops only its keys", func(t *testing.T) {
+		c, f := newTestCache(t, 0)
+		mustSave(t, c, "a", "1", "first")
+		mustSave(t, c, "b", "2", "first")
+		mustSave(t, c, "a", "3", "second")
+
+		err := c.InvalidateTable(ctx, "first")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{cacheKey("a", "first"), cacheKey("b", "first")} {
+			if f.has(key) {
+				t.Fatalf("%s isn't invalidated", key)
+			}
+		}
+		if !f.has(cacheKey("a", "second")) {
+			t.Fatal("key of other table is invalidated")
+		}
+		// renamed set is removed together with keys
+		for _, setKey := range f.setKeys() {
+			if strings.HasPrefix(setKey, tableSetKey("first")) {
+				t.Fatalf("set %s is left", setKey)
+			}
+		}
+	})
+
+	t.Run("tag drops only tagged keys", func(t *testing.T) {
+		c, f := newTestCache(t, 0)
+		mustSave(t, c, "a", "1", "first", storage.WithTags("tag"))
+		mustSave(t, c, "b", "2", "second", storage.WithTags("tag", "other"))
+		mustSave(t, c, "c", "3", "first", storage.WithTags("other"))
+		err := c.Tag(ctx, "d", "first", "tag")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.set(cacheKey("d", "first"), "loaded")
+
+		err = c.InvalidateTag(ctx, "tag")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{cacheKey("a", "first"), cacheKey("b", "second"), cacheKey("d", "first")} {
+			if f.has(key) {
+				t.Fatalf("%s isn't invalidated", key)
+			}
+		}
+		if !f.has(cacheKey("c", "first")) {
+			t.Fatal("key without tag is invalidated")
+		}
+	})
+
+	t.Run("key cached during invalidation is tracked by new set", func(t *testing.T) {
+		c, f := newTestCache(t, 0)
+		mustSave(t, c, "a", "1", "first")
+		// set is already renamed when it is scanned
+		f.onScan = func() {
+			mustSave(t, c, "b", "2", "first")
+		}
+
+		err := c.InvalidateTable(ctx, "first")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.has(cacheKey("a", "first")) {
+			t.Fatal("key cached before invalidation isn't invalidated")
+		}
+		if !f.has(cacheKey("b", "first")) || !f.inSet(tableSetKey("first"), cacheKey("b", "first")) {
+			t.Fatal("key cached during invalidation isn't tracked")
+		}
+
+		err = c.InvalidateTable(ctx, "first")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.has(cacheKey("b", "first")) {
+			t.Fatal("key cached during invalidation isn't invalidated next time")
+		}
+	})
+
+	t.Run("table without cached keys", func(t *testing.T) {
+		c, _ := newTestCache(t, 0)
+		err := c.InvalidateTable(ctx, "empty")
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("local caches are purged", func(t *testing.T) {
+		c, f := newTestCache(t, 1024)
+		mustSave(t, c, "a", "1", "first")
+		mustGet(t, c, "a", "first")
+
+		err := c.InvalidateTable(ctx, "first")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := c.l1.get(cacheKey("a", "first")); ok {
+			t.Fatal("local entry isn't purged")
+		}
+		want := c.l1.instanceID + ":" + l1PurgeKey
+		if n := len(f.published); n == 0 || f.published[n-1] != want {
+			t.Fatalf("published %v, want %s", f.published, want)
+		}
+	})
+
+	t.Run("failure is returned", func(t *testing.T) {
+		c, f := newTestCache(t, 0)
+		mustSave(t, c, "a", "1", "first")
+		f.setDown(true)
+		err := c.InvalidateTable(ctx, "first")
+		if !errors.Is(err, errRedisDown) {
+			t.Fatalf("invalidate error is %v, want %v", err, errRedisDown)
+		}
+	})
+}
+
+func TestReplayMissed(t *testing.T) {
+	ctx := context.Background()
+	const table = "values"
+
+	// newDegradingCache returns cache which breaker opens after consecutive failures of fake redis
+	newDegradingCache := func(t *testing.T, l1Size int64) (*cache, *fakeRedis) {
+		var c *cache
+		breaker := newBreaker(ctx, func(degraded bool) { c.setDegraded(degraded) })
+		c, f := newTestCache(t, l1Size, breakerHook{cb: breaker})
+		c.breaker = breaker
+		return c, f
+	}
+	// degrade fails writes of key until breaker opens, value saved before stays in redis
+	degrade := func(t *testing.T, c *cache, f *fakeRedis, key string) {
+		mustSave(t, c, key, "1", table)
+		f.setDown(true)
+		for i := 0; i < breakerConsecutiveFailures; i++ {
+			err := c.Save(ctx, key, "2", table)
+			if err == nil {
+				t.Fatal("save to unavailable redis succeeded")
+			}
+		}
+		if !c.Degraded() {
+			t.Fatal("cache isn't degraded")
+		}
+		err := c.Delete(ctx, key, table)
+		if !errors.Is(err, ErrUnavailable) {
+			t.Fatalf("delete error is %v, want %v", err, ErrUnavailable)
+		}
+		f.setDown(false)
+	}
+
+	t.Run("missed invalidation is replayed after recovery", func(t *testing.T) {
+		c, f := newDegradingCache(t, 0)
+		degrade(t, c, f, "a")
+		if !f.has(cacheKey("a", table)) {
+			t.Fatal("value is removed while cache is degraded")
+		}
+
+		c.breaker.SetState(circuitbreaker.StateClosed)
+		if c.Degraded() {
+			t.Fatal("cache is degraded after recovery")
+		}
+		c.replayBatch(ctx)
+		if f.has(cacheKey("a", table)) {
+			t.Fatal("stale value isn't removed after recovery")
+		}
+		if keys, _ := c.missed.take(missedReplayBatch); len(keys) != 0 {
+			t.Fatalf("missed invalidations %v are left", keys)
+		}
+	})
+
+	t.Run("failed replay keeps missed invalidations", func(t *testing.T) {
+		c, f := newDegradingCache(t, 0)
+		degrade(t, c, f, "a")
+		c.breaker.SetState(circuitbreaker.StateClosed)
+
+		f.setDown(true)
+		c.replayBatch(ctx)
+		f.setDown(false)
+		if !f.has(cacheKey("a", table)) {
+			t.Fatal("value is removed by failed replay")
+		}
+		c.replayBatch(ctx)
+		if f.has(cacheKey("a", table)) {
+			t.Fatal("stale value isn't removed by next replay")
+		}
+	})
+
+	t.Run("replay drops local entry", func(t *testing.T) {
+		c, f := newDegradingCache(t, 1024)
+		degrade(t, c, f, "a")
+		c.breaker.SetState(circuitbreaker.StateClosed)
+		// stale value is read before replay
+		mustGet(t, c, "a", table)
+
+		c.replayBatch(ctx)
+		if _, ok := c.l1.get(cacheKey("a", table)); ok {
+			t.Fatal("local entry isn't dropped by replay")
+		}
+	})
+}
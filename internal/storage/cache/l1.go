@@ -0,0 +1,190 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kjushka/microservice-gen/internal/logger"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	invalidationChannel = "storage-cache-invalidation"
+	// l1MaxAge bounds staleness of local entry when invalidation message is lost
+	l1MaxAge = 30 * time.Second
+	// every entry costs more than its key and data
+	l1EntryOverhead = 64
+	// invalidation of this key purges whole local cache, cache key always has table suffix
+	l1PurgeKey = "*"
+)
+
+// l1 is in-process LRU cache of encoded values limited by size in bytes
+type l1 struct {
+	// instanceID marks own invalidation messages
+	instanceID string
+	maxSize    int64
+
+	mu sync.Mutex
+	// generation is changed by every invalidation, value loaded before it isn't stored
+	generation uint64
+	size       int64
+	order      *list.List
+	entries    map[string]*list.Element
+}
+
+type l1Entry struct {
+	key       string
+	data      []byte
+	expiresAt time.Time
+}
+
+func newL1(maxSize int64) *l1 {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return &l1{
+		instanceID: hex.EncodeToString(id),
+		maxSize:    maxSize,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+func (l *l1) get(key string) ([]byte, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	el, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*l1Entry)
+	if time.Now().After(e.expiresAt) {
+		l.removeElement(el)
+		return nil, false
+	}
+	l.order.MoveToFront(el)
+	return e.data, true
+}
+
+func (l *l1) currentGeneration() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.generation
+}
+
+// set stores value loaded at generation, ttl is limited by l1MaxAge
+func (l *l1) set(key string, data []byte, ttl time.Duration, generation uint64) {
+	if ttl <= 0 || ttl > l1MaxAge {
+		ttl = l1MaxAge
+	}
+	entrySize := int64(len(key) + len(data) + l1EntryOverhead)
+	if entrySize > l.maxSize {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if generation != l.generation {
+		return
+	}
+	if el, ok := l.entries[key]; ok {
+		l.removeElement(el)
+	}
+	l.entries[key] = l.order.PushFront(&l1Entry{key: key, data: data, expiresAt: time.Now().Add(ttl)})
+	l.size += entrySize
+	for l.size > l.maxSize {
+		l.removeElement(l.order.Back())
+	}
+}
+
+func (l *l1) remove(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.generation++
+	if el, ok := l.entries[key]; ok {
+		l.removeElement(el)
+	}
+}
+
+func (l *l1) purge() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.generation++
+	l.order.Init()
+	l.entries = make(map[string]*list.Element)
+	l.size = 0
+}
+
+func (l *l1) removeElement(el *list.Element) {
+	e := l.order.Remove(el).(*l1Entry)
+	delete(l.entries, e.key)
+	l.size -= int64(len(e.key) + len(e.data) + l1EntryOverhead)
+}
+
+// invalidate removes key from local cache and from caches of other instances
+func (c *cache) invalidate(ctx context.Context, key string) {
+	if c.l1 == nil {
+		return
+	}
+	if key == l1PurgeKey {
+		c.l1.purge()
+	} else {
+		c.l1.remove(key)
+	}
+
+	err := c.redisClient.Publish(ctx, invalidationChannel, c.l1.instanceID+":"+key).Err()
+	if err != nil && !errors.Is(err, ErrUnavailable) {
+		// other instances keep stale entry up to l1MaxAge
+		logger.ErrorKV(ctx, "failed publish invalidation", "key", key, "error", err)
+	}
+}
+
+// invalidateAll purges local caches of all instances
+func (c *cache) invalidateAll(ctx context.Context) {
+	c.invalidate(ctx, l1PurgeKey)
+}
+
+// listenInvalidation removes keys changed by other instances from local cache until pubsub is closed
+func (c *cache) listenInvalidation(ctx context.Context, pubsub *redis.PubSub) {
+	for {
+		msg, err := pubsub.Receive(ctx)
+		if err == redis.ErrClosed {
+			return
+		}
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			// messages could be lost while subscription was broken
+			c.l1.purge()
+		case *redis.Message:
+			c.applyInvalidation(msg.Payload)
+		case *redis.Pong:
+		default:
+			if err != nil {
+				logger.ErrorKV(ctx, "failed receive invalidation", "error", err)
+				c.l1.purge()
+				time.Sleep(time.Second)
+			}
+		}
+	}
+}
+
+// applyInvalidation removes key of invalidation message from local cache, own messages are skipped
+func (c *cache) applyInvalidation(payload string) {
+	instanceID, key, ok := strings.Cut(payload, ":")
+	switch {
+	case !ok || instanceID == c.l1.instanceID:
+	case key == l1PurgeKey:
+		c.l1.purge()
+	default:
+		c.l1.remove(key)
+	}
+}
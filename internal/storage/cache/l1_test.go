@@ -0,0 +1,191 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+// entrySize is size of l1 entry with one byte key and one byte value
+const entrySize = 2 + l1EntryOverhead
+
+func TestL1(t *testing.T) {
+	t.Run("least recently used entry is evicted", func(t *testing.T) {
+		l := newL1(3 * entrySize)
+		l.set("a", []byte("1"), time.Minute, 0)
+		l.set("b", []byte("2"), time.Minute, 0)
+		l.set("c", []byte("3"), time.Minute, 0)
+		// a becomes most recently used, so b is evicted
+		if _, ok := l.get("a"); !ok {
+			t.Fatal("a is missing")
+		}
+		l.set("d", []byte("4"), time.Minute, 0)
+
+		if _, ok := l.get("b"); ok {
+			t.Fatal("least recently used b isn't evicted")
+		}
+		for _, key := range []string{"a", "c", "d"} {
+			if _, ok := l.get(key); !ok {
+				t.Fatalf("%s is evicted", key)
+			}
+		}
+		if l.size != 3*entrySize {
+			t.Fatalf("size is %d, want %d", l.size, 3*entrySize)
+		}
+	})
+
+	t.Run("replaced entry keeps size", func(t *testing.T) {
+		l := newL1(3 * entrySize)
+		l.set("a", []byte("1"), time.Minute, 0)
+		l.set("a", []byte("2"), time.Minute, 0)
+		data, ok := l.get("a")
+		if !ok || string(data) != "2" {
+			t.Fatalf("got '%s', want '2'", data)
+		}
+		if l.size != entrySize {
+			t.Fatalf("size is %d, want %d", l.size, entrySize)
+		}
+	})
+
+	t.Run("entry larger than cache isn't stored", func(t *testing.T) {
+		l := newL1(entrySize)
+		l.set("a", []byte("12"), time.Minute, 0)
+		if _, ok := l.get("a"); ok {
+			t.Fatal("oversized entry is stored")
+		}
+	})
+
+	t.Run("expired entry is dropped", func(t *testing.T) {
+		l := newL1(3 * entrySize)
+		l.set("a", []byte("1"), time.Millisecond, 0)
+		time.Sleep(5 * time.Millisecond)
+		if _, ok := l.get("a"); ok {
+			t.Fatal("expired entry is returned")
+		}
+		if l.size != 0 {
+			t.Fatalf("size is %d, want 0", l.size)
+		}
+	})
+
+	t.Run("ttl is limited by max age", func(t *testing.T) {
+		l := newL1(3 * entrySize)
+		for key, ttl := range map[string]time.Duration{"a": 0, "b": time.Hour} {
+			l.set(key, []byte("1"), ttl, 0)
+			expiresAt := l.entries[key].Value.(*l1Entry).expiresAt
+			if until := time.Until(expiresAt); until > l1MaxAge {
+				t.Fatalf("entry of ttl %v expires in %v, want not later than %v", ttl, until, l1MaxAge)
+			}
+		}
+	})
+
+	t.Run("value loaded before invalidation isn't stored", func(t *testing.T) {
+		l := newL1(3 * entrySize)
+		generation := l.currentGeneration()
+		l.remove("a")
+		l.set("a", []byte("1"), time.Minute, generation)
+		if _, ok := l.get("a"); ok {
+			t.Fatal("value loaded before invalidation is stored")
+		}
+	})
+
+	t.Run("purge drops every entry", func(t *testing.T) {
+		l := newL1(3 * entrySize)
+		l.set("a", []byte("1"), time.Minute, 0)
+		l.set("b", []byte("2"), time.Minute, 0)
+		l.purge()
+		for _, key := range []string{"a", "b"} {
+			if _, ok := l.get(key); ok {
+				t.Fatalf("%s isn't purged", key)
+			}
+		}
+		if l.size != 0 {
+			t.Fatalf("size is %d, want 0", l.size)
+		}
+	})
+}
+
+func TestL1Invalidation(t *testing.T) {
+	ctx := context.Background()
+	const table = "values"
+
+	t.Run("get stores value in l1", func(t *testing.T) {
+		c, f := newTestCache(t, 1024)
+		mustSave(t, c, "a", "1", table)
+		mustGet(t, c, "a", table)
+		// value is read from l1 while redis is down
+		f.setDown(true)
+		if value := mustGet(t, c, "a", table); value != "1" {
+			t.Fatalf("got '%s', want '1'", value)
+		}
+	})
+
+	t.Run("save drops l1 entry and notifies other instances", func(t *testing.T) {
+		c, f := newTestCache(t, 1024)
+		mustSave(t, c, "a", "1", table)
+		mustGet(t, c, "a", table)
+		mustSave(t, c, "a", "2", table)
+
+		if value := mustGet(t, c, "a", table); value != "2" {
+			t.Fatalf("got '%s', want '2'", value)
+		}
+		want := c.l1.instanceID + ":" + cacheKey("a", table)
+		if n := len(f.published); n == 0 || f.published[n-1] != want {
+			t.Fatalf("published %v, want %s", f.published, want)
+		}
+	})
+
+	t.Run("delete drops l1 entry", func(t *testing.T) {
+		c, _ := newTestCache(t, 1024)
+		mustSave(t, c, "a", "1", table)
+		mustGet(t, c, "a", table)
+		err := c.Delete(ctx, "a", table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := c.l1.get(cacheKey("a", table)); ok {
+			t.Fatal("deleted key is in l1")
+		}
+	})
+
+	t.Run("invalidation of other instance drops l1 entry", func(t *testing.T) {
+		c, f := newTestCache(t, 1024)
+		mustSave(t, c, "a", "1", table)
+		mustGet(t, c, "a", table)
+		// other instance changed value
+		buf := &bytes.Buffer{}
+		_ = c.serializer.Encode(buf, "2")
+		f.set(cacheKey("a", table), buf.String())
+
+		c.applyInvalidation("other:" + cacheKey("a", table))
+		if value := mustGet(t, c, "a", table); value != "2" {
+			t.Fatalf("got '%s', want '2'", value)
+		}
+	})
+
+	t.Run("own invalidation is skipped", func(t *testing.T) {
+		c, _ := newTestCache(t, 1024)
+		mustSave(t, c, "a", "1", table)
+		mustGet(t, c, "a", table)
+
+		c.applyInvalidation(c.l1.instanceID + ":" + cacheKey("a", table))
+		if _, ok := c.l1.get(cacheKey("a", table)); !ok {
+			t.Fatal("own invalidation dropped l1 entry")
+		}
+	})
+
+	t.Run("purge message drops every entry", func(t *testing.T) {
+		c, _ := newTestCache(t, 1024)
+		mustSave(t, c, "a", "1", table)
+		mustSave(t, c, "b", "2", table)
+		mustGet(t, c, "a", table)
+		mustGet(t, c, "b", table)
+
+		c.applyInvalidation("other:" + l1PurgeKey)
+		for _, key := range []string{"a", "b"} {
+			if _, ok := c.l1.get(cacheKey(key, table)); ok {
+				t.Fatalf("%s isn't purged", key)
+			}
+		}
+	})
+}
@@ -0,0 +1,308 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kjushka/microservice-gen/internal/storage"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	writeBehindStream = "storage-write-behind"
+	writeBehindGroup  = "flushers"
+	// writes which can't be flushed are kept here for investigation and manual replay
+	writeBehindDeadStream = "storage-write-behind-dead"
+	// holder of lease is the only flusher, so writes are applied in queued order
+	writeBehindLeaseKey = "storage-write-behind-lease"
+)
+
+var (
+	// acquireLeaseScript extends lease of holder or takes free lease
+	acquireLeaseScript = redis.NewScript(`
+		if redis.call("get", KEYS[1]) == ARGV[1] then
+			return redis.call("pexpire", KEYS[1], ARGV[2])
+		end
+		if redis.call("set", KEYS[1], ARGV[1], "nx", "px", ARGV[2]) then
+			return 1
+		end
+		return 0
+	`)
+	releaseLeaseScript = redis.NewScript(`
+		if redis.call("get", KEYS[1]) == ARGV[1] then
+			return redis.call("del", KEYS[1])
+		end
+		return 0
+	`)
+)
+
+// QueuedWrite is change of record waiting to be flushed to database
+type QueuedWrite struct {
+	ID    string
+	Key   string
+	Table string
+	Data  []byte
+	// zero if record never expires, moment is fixed at save, so flush delay doesn't prolong record
+	ExpiresAt time.Time
+	Delete    bool
+	// Deliveries counts reads of write by flushers including current one
+	Deliveries int64
+}
+
+func (c *cache) SaveBehind(ctx context.Context, key string, table string, data []byte, opts ...storage.SaveOption) error {
+	ctx, span := c.tracer.Start(ctx, "save behind to cache")
+	defer span.End()
+
+	o := storage.NewSaveOptions(opts...)
+	ttl := o.TTL
+	if !o.ExpiresAt.IsZero() {
+		// already expired record lives in cache till flush at least
+		ttl = time.Until(o.ExpiresAt)
+		if ttl < time.Millisecond {
+			ttl = time.Millisecond
+		}
+	} else if o.TTL > 0 {
+		o.ExpiresAt = time.Now().Add(o.TTL)
+	}
+	cacheKey := fmt.Sprintf("%s-%s", key, table)
+	_, err := c.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, cacheKey, c.wrap(data, ttl), c.ttl(ttl))
+		c.track(ctx, pipe, cacheKey, table, o.Tags)
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: writeBehindStream,
+			Values: map[string]any{"key": key, "table": table, "data": data, "expires_at": unixMilli(o.ExpiresAt)},
+		})
+		return nil
+	})
+	if err != nil {
+		c.writeFailed(cacheKey, err)
+		return fmt.Errorf("failed save behind to redis: %w", err)
+	}
+	c.invalidate(ctx, cacheKey)
+
+	return nil
+}
+
+func (c *cache) DeleteBehind(ctx context.Context, key string, table string) error {
+	ctx, span := c.tracer.Start(ctx, "delete behind in cache")
+	defer span.End()
+
+	cacheKey := fmt.Sprintf("%s-%s", key, table)
+	_, err := c.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, cacheKey)
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: writeBehindStream,
+			Values: map[string]any{"key": key, "table": table, "delete": 1},
+		})
+		return nil
+	})
+	if err != nil {
+		c.writeFailed(cacheKey, err)
+		return fmt.Errorf("failed delete behind in redis: %w", err)
+	}
+	c.invalidate(ctx, cacheKey)
+
+	return nil
+}
+
+func (c *cache) ReadBehind(ctx context.Context, consumer string, count int64, block time.Duration) ([]QueuedWrite, error) {
+	if !c.behindGroupCreated.Load() {
+		err := c.redisClient.XGroupCreateMkStream(ctx, writeBehindStream, writeBehindGroup, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return nil, fmt.Errorf("failed create consumer group: %w", err)
+		}
+		c.behindGroupCreated.Store(true)
+	}
+
+	// own records which weren't acknowledged go first, they are older than new ones.
+	// Records of previous lease holder are claimed at once, it stopped flushing when its lease expired
+	streams, err := c.redisClient.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    writeBehindGroup,
+		Consumer: consumer,
+		Streams:  []string{writeBehindStream, "0"},
+		Count:    count,
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed read pending records: %w", err)
+	}
+	if len(streams) > 0 && len(streams[0].Messages) > 0 {
+		return c.redelivered(ctx, consumer, streams[0].Messages)
+	}
+
+	messages, _, err := c.redisClient.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+		Stream:   writeBehindStream,
+		Group:    writeBehindGroup,
+		Consumer: consumer,
+		MinIdle:  0,
+		Start:    "0",
+		Count:    count,
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed claim abandoned records: %w", err)
+	}
+	if len(messages) > 0 {
+		return c.redelivered(ctx, consumer, messages)
+	}
+
+	streams, err = c.redisClient.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    writeBehindGroup,
+		Consumer: consumer,
+		Streams:  []string{writeBehindStream, ">"},
+		Count:    count,
+		Block:    block,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed read new records: %w", err)
+	}
+	writes, err := queuedWrites(streams[0].Messages)
+	if err != nil {
+		return nil, err
+	}
+	for i := range writes {
+		writes[i].Deliveries = 1
+	}
+	return writes, nil
+}
+
+// redelivered fills deliveries of writes read again from pending entries of consumer
+func (c *cache) redelivered(ctx context.Context, consumer string, messages []redis.XMessage) ([]QueuedWrite, error) {
+	writes, err := queuedWrites(messages)
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := c.redisClient.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream:   writeBehindStream,
+		Group:    writeBehindGroup,
+		Start:    writes[0].ID,
+		End:      writes[len(writes)-1].ID,
+		Count:    int64(len(writes)),
+		Consumer: consumer,
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed read deliveries of records: %w", err)
+	}
+	deliveries := make(map[string]int64, len(pending))
+	for _, p := range pending {
+		deliveries[p.ID] = p.RetryCount
+	}
+	for i := range writes {
+		writes[i].Deliveries = deliveries[writes[i].ID]
+	}
+	return writes, nil
+}
+
+func (c *cache) AcquireBehindLease(ctx context.Context, consumer string, ttl time.Duration) (bool, error) {
+	acquired, err := acquireLeaseScript.Run(ctx, c.redisClient, []string{writeBehindLeaseKey}, consumer, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed acquire flusher lease: %w", err)
+	}
+	return acquired == 1, nil
+}
+
+func (c *cache) ReleaseBehindLease(ctx context.Context, consumer string) error {
+	err := releaseLeaseScript.Run(ctx, c.redisClient, []string{writeBehindLeaseKey}, consumer).Err()
+	if err != nil {
+		return fmt.Errorf("failed release flusher lease: %w", err)
+	}
+	return nil
+}
+
+func (c *cache) AckBehind(ctx context.Context, ids ...string) error {
+	_, err := c.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAck(ctx, writeBehindStream, writeBehindGroup, ids...)
+		pipe.XDel(ctx, writeBehindStream, ids...)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed acknowledge records: %w", err)
+	}
+
+	return nil
+}
+
+func queuedWrites(messages []redis.XMessage) ([]QueuedWrite, error) {
+	writes := make([]QueuedWrite, 0, len(messages))
+	for _, m := range messages {
+		w := QueuedWrite{ID: m.ID}
+		w.Key, _ = m.Values["key"].(string)
+		w.Table, _ = m.Values["table"].(string)
+		_, w.Delete = m.Values["delete"]
+		if !w.Delete {
+			data, _ := m.Values["data"].(string)
+			w.Data = []byte(data)
+			expiresAt, err := queuedExpiry(m)
+			if err != nil {
+				return nil, fmt.Errorf("failed parse expiry of record '%s': %v", m.ID, err)
+			}
+			w.ExpiresAt = expiresAt
+		}
+		writes = append(writes, w)
+	}
+	return writes, nil
+}
+
+// queuedExpiry reads moment of expiry of queued record, records queued by previous versions
+// have relative ttl which is counted from time of their id
+func queuedExpiry(m redis.XMessage) (time.Time, error) {
+	if value, ok := m.Values["expires_at"]; ok {
+		ms, err := strconv.ParseInt(fmt.Sprint(value), 10, 64)
+		if err != nil || ms == 0 {
+			return time.Time{}, err
+		}
+		return time.UnixMilli(ms), nil
+	}
+
+	ttl, err := strconv.ParseInt(fmt.Sprint(m.Values["ttl"]), 10, 64)
+	if err != nil || ttl <= 0 {
+		return time.Time{}, err
+	}
+	queuedAt, err := strconv.ParseInt(strings.SplitN(m.ID, "-", 2)[0], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(queuedAt + ttl), nil
+}
+
+// unixMilli is zero for zero moment, it means record never expires
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// DeadLetterBehind moves write to dead letter stream with reason. Cached value of record is removed,
+// it holds change which database never got
+func (c *cache) DeadLetterBehind(ctx context.Context, write QueuedWrite, reason error) error {
+	ctx, span := c.tracer.Start(ctx, "dead letter behind in cache")
+	defer span.End()
+
+	values := map[string]any{"id": write.ID, "key": write.Key, "table": write.Table, "error": reason.Error()}
+	if write.Delete {
+		values["delete"] = 1
+	} else {
+		values["data"] = write.Data
+		values["expires_at"] = unixMilli(write.ExpiresAt)
+	}
+	cacheKey := fmt.Sprintf("%s-%s", write.Key, write.Table)
+	_, err := c.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAdd(ctx, &redis.XAddArgs{Stream: writeBehindDeadStream, Values: values})
+		pipe.XAck(ctx, writeBehindStream, writeBehindGroup, write.ID)
+		pipe.XDel(ctx, writeBehindStream, write.ID)
+		pipe.Del(ctx, cacheKey)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed move record '%s' to dead letter stream: %w", write.ID, err)
+	}
+	c.invalidate(ctx, cacheKey)
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kjushka/microservice-gen/internal/storage"
+)
+
+// Write is encoded change of one record, Data and ExpiresAt are ignored for delete
+type Write struct {
+	Key   string
+	Table string
+	Data  []byte
+	// zero if record never expires. Moment is absolute, so delayed write doesn't prolong record
+	ExpiresAt time.Time
+	Delete    bool
+}
+
+func (d *dbStorage) WriteBatch(ctx context.Context, writes []Write) error {
+	ctx, span := d.tracer.Start(ctx, "write batch to db")
+	defer span.End()
+
+	tx, err := d.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed begin transaction: %v", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	for _, w := range writes {
+		if w.Delete {
+			err = remove(ctx, tx, w.Key, w.Table)
+		} else {
+			err = upsert(ctx, tx, w.Key, w.Table, w.Data, storage.WithExpiresAt(w.ExpiresAt))
+		}
+		if err != nil {
+			return fmt.Errorf("failed write '%s' to '%s': %v", w.Key, w.Table, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed commit transaction: %v", err)
+	}
+	d.replicas.wrote(ctx)
+
+	return nil
+}
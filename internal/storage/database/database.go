@@ -3,6 +3,7 @@ package database
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"fmt"
 	"github.com/kjushka/microservice-gen/internal/closer"
 	"github.com/kjushka/microservice-gen/internal/config"
@@ -20,10 +21,30 @@ import (
 
 type DBStorage interface {
 	storage.Storage
+	storage.Watcher
 	GetDB() *sqlx.DB
+	// Serializer decodes data returned by GetRaw
+	Serializer() serializer.Serializer
+	// GetRaw returns encoded record of primary, it can be stored in cache as is
+	GetRaw(ctx context.Context, key string, table string) ([]byte, storage.Meta, error)
+	// RecentKeys returns up to limit keys of last changed records of table
+	RecentKeys(ctx context.Context, table string, limit int) ([]string, error)
+	// RunSweeper removes expired records and old events until ctx is done
+	RunSweeper(ctx context.Context)
+	// RunReencrypt encrypts records by current key once per key id and drops their cached values
+	RunReencrypt(ctx context.Context, invalidator storage.Invalidator)
+	// RunReplicaMonitor ejects lagging read replicas until ctx is done
+	RunReplicaMonitor(ctx context.Context)
+	// WriteBatch applies encoded changes in one transaction in given order
+	WriteBatch(ctx context.Context, writes []Write) error
 }
 
 func InitDB(ctx context.Context, cfg *config.Config, tracer trace.Tracer) (DBStorage, error) {
+	s, err := serializer.Init(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed create serializer")
+	}
+
 	connStr := fmt.Sprintf(
 		"postgres://%s:%s@%s:%s/%s?sslmode=disable",
 		cfg.DBUser,
@@ -48,86 +69,226 @@ func InitDB(ctx context.Context, cfg *config.Config, tracer trace.Tracer) (DBSto
 
 	closer.Add(db.Close)
 
+	replicas, err := newReplicaSet(ctx, db, cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	return &dbStorage{
 		db,
-		serializer.NewMessagePackSerializer(),
+		replicas,
+		newEventHub(connStr),
+		cfg.DBSweepInterval,
+		cfg.DBEventsRetention,
+		s,
 		tracer,
 	}, nil
 }
 
 type dbStorage struct {
-	db         *sqlx.DB
-	serializer *serializer.MessagePackSerializer
-	tracer     trace.Tracer
+	db *sqlx.DB
+	// Get, GetMany and List are served by replicas, the rest goes to primary db
+	replicas        *replicaSet
+	events          *eventHub
+	sweepInterval   time.Duration
+	eventsRetention time.Duration
+	serializer      serializer.Serializer
+	tracer          trace.Tracer
 }
 
 func (d *dbStorage) GetDB() *sqlx.DB {
 	return d.db
 }
 
+func (d *dbStorage) Serializer() serializer.Serializer {
+	return d.serializer
+}
+
 func (d *dbStorage) Get(ctx context.Context, key string, table string, dest any) error {
-	ctx, span := d.tracer.Start(ctx, "get from cache")
+	_, err := d.get(ctx, d.replicas.reader(ctx), key, table, dest)
+	return err
+}
+
+// GetWithMeta reads primary, revision of replica can be behind
+func (d *dbStorage) GetWithMeta(ctx context.Context, key string, table string, dest any) (storage.Meta, error) {
+	return d.get(ctx, d.db, key, table, dest)
+}
+
+func (d *dbStorage) get(ctx context.Context, db *sqlx.DB, key string, table string, dest any) (storage.Meta, error) {
+	data, meta, err := d.getRaw(ctx, db, key, table)
+	if err != nil {
+		return storage.Meta{}, err
+	}
+
+	err = d.serializer.Decode(bytes.NewReader(data), dest)
+	if err != nil {
+		return storage.Meta{}, fmt.Errorf("failed decode data: %v", err)
+	}
+
+	return meta, nil
+}
+
+func (d *dbStorage) RecentKeys(ctx context.Context, table string, limit int) ([]string, error) {
+	ctx, span := d.tracer.Start(ctx, "get recent keys from db")
+	defer span.End()
+
+	var keys []string
+	err := d.db.SelectContext(ctx, &keys, strings.ReplaceAll(`
+		select uid from table
+		where expires_at is null or expires_at > now()
+		order by revision desc
+		limit $1;
+	`, "table", table), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed get recent keys from db: %v", err)
+	}
+
+	return keys, nil
+}
+
+// GetRaw reads primary, its result fills cache and lagging replica would pin old value there
+func (d *dbStorage) GetRaw(ctx context.Context, key string, table string) ([]byte, storage.Meta, error) {
+	return d.getRaw(ctx, d.db, key, table)
+}
+
+func (d *dbStorage) getRaw(ctx context.Context, db *sqlx.DB, key string, table string) ([]byte, storage.Meta, error) {
+	ctx, span := d.tracer.Start(ctx, "get from db")
 	defer span.End()
 
 	var err error
-	queryRow := d.db.QueryRowContext(ctx, strings.ReplaceAll(`
-		select data from table where uid = $1;
+	queryRow := db.QueryRowContext(ctx, strings.ReplaceAll(`
+		select data, revision, expires_at from table
+		where uid = $1 and (expires_at is null or expires_at > now());
 	`, "table", table), key)
 	if err = queryRow.Err(); err != nil {
-		return fmt.Errorf("failed get from db: %s", err)
+		return nil, storage.Meta{}, fmt.Errorf("failed get from db: %s", err)
 	}
 
-	var data []byte
-	err = queryRow.Scan(&data)
-
-	if err != nil {
-		return err
+	var (
+		data      []byte
+		revision  int64
+		expiresAt sql.NullTime
+	)
+	err = queryRow.Scan(&data, &revision, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.Meta{}, storage.ErrNotFound
 	}
-
-	err = d.serializer.Decode(bytes.NewReader(data), dest)
 	if err != nil {
-		return fmt.Errorf("failed decode data: %v", err)
+		return nil, storage.Meta{}, fmt.Errorf("failed scan data: %v", err)
 	}
 
-	return nil
+	return data, storage.Meta{Revision: revision, ExpiresAt: expiresAt.Time}, nil
 }
 
 func (d *dbStorage) GetMany(ctx context.Context, keys []string, table string, dest ...any) error {
-	ctx, span := d.tracer.Start(ctx, "get from cache")
+	ctx, span := d.tracer.Start(ctx, "get many from db")
 	defer span.End()
 
-	var err error
-	queryBase := strings.ReplaceAll(`select data from table where uid in (?);`, "table", table)
+	if len(keys) != len(dest) {
+		return errors.New("len of keys not equal len of dest")
+	}
+
+	queryBase := strings.ReplaceAll(`
+		select uid, data from table
+		where uid in (?) and (expires_at is null or expires_at > now());
+	`, "table", table)
 	query, params, err := sqlx.In(queryBase, keys)
 	if err != nil {
 		return fmt.Errorf("failed prepare query: %v", err)
 	}
 
-	rows, err := d.db.QueryContext(ctx, query, params)
+	db := d.replicas.reader(ctx)
+	rows, err := db.QueryContext(ctx, db.Rebind(query), params...)
 	if err != nil {
 		return fmt.Errorf("failed get from db: %s", err)
 	}
+	defer rows.Close()
 
-	var counter int
+	found := make(map[string][]byte, len(keys))
 	for rows.Next() {
-		var data []byte
-		err = rows.Scan(&data)
-
+		var (
+			uid  string
+			data []byte
+		)
+		err = rows.Scan(&uid, &data)
 		if err != nil {
-			return err
+			return fmt.Errorf("failed scan data: %v", err)
 		}
+		found[uid] = data
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed read rows: %v", err)
+	}
 
-		err = d.serializer.Decode(bytes.NewReader(data), dest[counter])
+	var missing []string
+	for i, key := range keys {
+		data, ok := found[key]
+		if !ok {
+			missing = append(missing, key)
+			continue
+		}
+		err = d.serializer.Decode(bytes.NewReader(data), dest[i])
 		if err != nil {
 			return fmt.Errorf("failed decode data: %v", err)
 		}
 	}
+	if len(missing) > 0 {
+		return &storage.MissingKeysError{Table: table, Keys: missing}
+	}
 
 	return nil
 }
 
-func (d *dbStorage) Save(ctx context.Context, key string, data any, table string) error {
-	ctx, span := d.tracer.Start(ctx, "save to cache")
+func (d *dbStorage) List(ctx context.Context, table string, prefix string, pageToken string, limit int) ([]storage.Item, string, error) {
+	ctx, span := d.tracer.Start(ctx, "list from db")
+	defer span.End()
+
+	if limit <= 0 {
+		return nil, "", storage.ErrInvalidLimit
+	}
+	lastKey, err := storage.DecodePageToken(pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// one extra row shows that there is next page
+	rows, err := d.replicas.reader(ctx).QueryContext(ctx, strings.ReplaceAll(`
+		select uid, data, revision from table
+		where starts_with(uid, $1) and uid > $2 and (expires_at is null or expires_at > now())
+		order by uid
+		limit $3;
+	`, "table", table), prefix, lastKey, limit+1)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed list from db: %v", err)
+	}
+	defer rows.Close()
+
+	items := make([]storage.Item, 0, limit)
+	for rows.Next() {
+		var (
+			uid      string
+			data     []byte
+			revision int64
+		)
+		err = rows.Scan(&uid, &data, &revision)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed scan data: %v", err)
+		}
+		items = append(items, storage.NewItem(uid, revision, data, d.serializer.Decode))
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("failed read rows: %v", err)
+	}
+
+	if len(items) <= limit {
+		return items, "", nil
+	}
+	items = items[:limit]
+	return items, storage.EncodePageToken(items[limit-1].Key), nil
+}
+
+func (d *dbStorage) Save(ctx context.Context, key string, data any, table string, opts ...storage.SaveOption) error {
+	ctx, span := d.tracer.Start(ctx, "save to db")
 	defer span.End()
 
 	buf := bytes.NewBuffer(nil)
@@ -136,27 +297,192 @@ func (d *dbStorage) Save(ctx context.Context, key string, data any, table string
 		return fmt.Errorf("failed encode data: %v", err)
 	}
 
-	_, err = d.db.ExecContext(ctx, strings.ReplaceAll(`
-		insert into table (uid, data)
-		values ($1, $2) on conflict (uid) do
-	update
-	set data = excluded.data;
-	`, "table", table), key)
+	tx, err := d.db.BeginTxx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed upsert data: %v", err)
+		return fmt.Errorf("failed begin transaction: %v", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	err = upsert(ctx, tx, key, table, buf.Bytes(), opts...)
+	if err != nil {
+		return err
 	}
 
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed commit transaction: %v", err)
+	}
+	d.replicas.wrote(ctx)
+
 	return nil
 }
 
+func (d *dbStorage) SaveIf(
+	ctx context.Context,
+	key string,
+	table string,
+	data any,
+	expectedRevision int64,
+	opts ...storage.SaveOption,
+) (int64, error) {
+	ctx, span := d.tracer.Start(ctx, "conditional save to db")
+	defer span.End()
+
+	buf := bytes.NewBuffer(nil)
+	err := d.serializer.Encode(buf, data)
+	if err != nil {
+		return 0, fmt.Errorf("failed encode data: %v", err)
+	}
+
+	tx, err := d.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed begin transaction: %v", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	revision, err := publishEvent(ctx, tx, storage.EventPut, table, key)
+	if err != nil {
+		return 0, err
+	}
+
+	// expired record is treated as missing one
+	var res sql.Result
+	if expectedRevision == 0 {
+		res, err = tx.ExecContext(ctx, strings.ReplaceAll(`
+			insert into table as t (uid, data, revision, expires_at)
+			values ($1, $2, $3, coalesce($5::timestamptz, now() + $4 * interval '1 millisecond')) on conflict (uid) do
+			update
+			set data = excluded.data, revision = excluded.revision, expires_at = excluded.expires_at
+			where t.expires_at <= now();
+		`, "table", table), key, buf.Bytes(), revision, ttlMillis(opts), expiresAt(opts))
+	} else {
+		res, err = tx.ExecContext(ctx, strings.ReplaceAll(`
+			update table
+			set data = $2, revision = $3, expires_at = coalesce($6::timestamptz, now() + $4 * interval '1 millisecond')
+			where uid = $1 and revision = $5 and (expires_at is null or expires_at > now());
+		`, "table", table), key, buf.Bytes(), revision, ttlMillis(opts), expectedRevision, expiresAt(opts))
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed save data: %v", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed get affected rows: %v", err)
+	}
+
+	if affected == 0 {
+		var actual int64
+		err = tx.QueryRowContext(ctx, strings.ReplaceAll(`
+			select revision from table
+			where uid = $1 and (expires_at is null or expires_at > now());
+		`, "table", table), key).Scan(&actual)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("failed get actual revision: %v", err)
+		}
+		return 0, &storage.ConflictError{
+			Table:            table,
+			Key:              key,
+			ExpectedRevision: expectedRevision,
+			ActualRevision:   actual,
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("failed commit transaction: %v", err)
+	}
+	d.replicas.wrote(ctx)
+
+	return revision, nil
+}
+
 func (d *dbStorage) Delete(ctx context.Context, key string, table string) error {
-	ctx, span := d.tracer.Start(ctx, "save to cache")
+	ctx, span := d.tracer.Start(ctx, "delete in db")
 	defer span.End()
 
-	_, err := d.db.ExecContext(ctx, strings.ReplaceAll(`delete from table where uid = $1;`, "table", table), key)
+	tx, err := d.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed begin transaction: %v", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	err = remove(ctx, tx, key, table)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed commit transaction: %v", err)
+	}
+	d.replicas.wrote(ctx)
+
+	return nil
+}
+
+// upsert must be called in transaction, it publishes event and saves encoded data
+func upsert(ctx context.Context, tx *sqlx.Tx, key string, table string, data []byte, opts ...storage.SaveOption) error {
+	revision, err := publishEvent(ctx, tx, storage.EventPut, table, key)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, strings.ReplaceAll(`
+		insert into table (uid, data, revision, expires_at)
+		values ($1, $2, $3, coalesce($5::timestamptz, now() + $4 * interval '1 millisecond')) on conflict (uid) do
+	update
+	set data = excluded.data, revision = excluded.revision, expires_at = excluded.expires_at;
+	`, "table", table), key, data, revision, ttlMillis(opts), expiresAt(opts))
+	if err != nil {
+		return fmt.Errorf("failed upsert data: %v", err)
+	}
+
+	return nil
+}
+
+// remove must be called in transaction, it publishes event and removes record.
+// Event is removed too if there was no record
+func remove(ctx context.Context, tx *sqlx.Tx, key string, table string) error {
+	revision, err := publishEvent(ctx, tx, storage.EventDelete, table, key)
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx, strings.ReplaceAll(`delete from table where uid = $1;`, "table", table), key)
 	if err != nil {
 		return fmt.Errorf("failed remove data from db: %v", err)
 	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed get affected rows: %v", err)
+	}
+	if affected > 0 {
+		return nil
+	}
 
+	_, err = tx.ExecContext(ctx, `delete from storage_events where revision = $1;`, revision)
+	if err != nil {
+		return fmt.Errorf("failed remove event: %v", err)
+	}
 	return nil
 }
+
+// ttlMillis returns nil for records without ttl or with moment of expiry, so expires_at becomes null
+// or expiresAt
+func ttlMillis(opts []storage.SaveOption) *int64 {
+	o := storage.NewSaveOptions(opts...)
+	if o.TTL <= 0 || !o.ExpiresAt.IsZero() {
+		return nil
+	}
+	ms := o.TTL.Milliseconds()
+	return &ms
+}
+
+// expiresAt returns nil for records without moment of expiry, ttl is used for them
+func expiresAt(opts []storage.SaveOption) *time.Time {
+	o := storage.NewSaveOptions(opts...)
+	if o.ExpiresAt.IsZero() {
+		return nil
+	}
+	return &o.ExpiresAt
+}
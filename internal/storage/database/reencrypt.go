@@ -0,0 +1,163 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/kjushka/microservice-gen/internal/logger"
+	"github.com/kjushka/microservice-gen/internal/storage"
+	"github.com/kjushka/microservice-gen/internal/storage/serializer"
+)
+
+const (
+	reencryptBatch = 1000
+	// reencryptLockID lets only one instance rewrite records
+	reencryptLockID = 2023061500
+)
+
+// RunReencrypt encrypts records written before encryption was enabled and rewrites records encrypted
+// by old keys. Revisions aren't changed, records values stay the same. Cache keeps blobs of old keys,
+// so cached values of every scanned table are dropped, including ones rewritten by interrupted run.
+// Completed run is marked with current key id, so next starts don't scan tables again.
+// Encryption switched off and on again needs new key id to be reencrypted
+func (d *dbStorage) RunReencrypt(ctx context.Context, invalidator storage.Invalidator) {
+	r, ok := d.serializer.(serializer.Reencrypter)
+	if !ok {
+		return
+	}
+
+	result, err := d.reencrypt(ctx, r, invalidator)
+	if err != nil {
+		logger.ErrorKV(ctx, "failed reencrypt records", "error", err)
+		return
+	}
+	switch result {
+	case reencryptLocked:
+		logger.InfoKV(ctx, "records are reencrypted by other instance")
+	case reencryptSkipped:
+		logger.InfoKV(ctx, "records are already encrypted by current key", "key", r.CurrentKeyID())
+	default:
+		logger.InfoKV(ctx, "records reencrypted, old keys can be removed from keyfile", "key", r.CurrentKeyID())
+	}
+}
+
+type reencryptResult int
+
+const (
+	reencryptDone reencryptResult = iota
+	// other instance holds the lock
+	reencryptLocked
+	// records were reencrypted by current key before
+	reencryptSkipped
+)
+
+func (d *dbStorage) reencrypt(ctx context.Context, r serializer.Reencrypter, invalidator storage.Invalidator) (reencryptResult, error) {
+	// session lock is bound to connection, so one connection is kept till the end
+	conn, err := d.db.Connx(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed get connection: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	var locked bool
+	err = conn.QueryRowContext(ctx, `select pg_try_advisory_lock($1);`, reencryptLockID).Scan(&locked)
+	if err != nil {
+		return 0, fmt.Errorf("failed lock reencryption: %v", err)
+	}
+	if !locked {
+		return reencryptLocked, nil
+	}
+	defer func() {
+		_, _ = conn.ExecContext(context.Background(), `select pg_advisory_unlock($1);`, reencryptLockID)
+	}()
+
+	ctx, span := d.tracer.Start(ctx, "reencrypt db")
+	defer span.End()
+
+	_, err = d.db.ExecContext(ctx, `
+		create table if not exists reencryption (
+			key_id       bigint      primary key,
+			completed_at timestamptz not null
+		);
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed create reencryption table: %v", err)
+	}
+	var completed bool
+	err = d.db.QueryRowContext(ctx, `
+		select exists(select 1 from reencryption where key_id = $1);
+	`, r.CurrentKeyID()).Scan(&completed)
+	if err != nil {
+		return 0, fmt.Errorf("failed check reencryption marker: %v", err)
+	}
+	if completed {
+		return reencryptSkipped, nil
+	}
+
+	var tables []string
+	err = d.db.SelectContext(ctx, &tables, `
+		select table_name from information_schema.columns
+		where column_name = 'data' and data_type = 'bytea' and table_schema = current_schema();
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed get tables: %v", err)
+	}
+
+	for _, table := range tables {
+		err = d.reencryptTable(ctx, r, table)
+		if err != nil {
+			return 0, fmt.Errorf("failed reencrypt '%s': %v", table, err)
+		}
+		err = invalidator.InvalidateTable(ctx, table)
+		if err != nil {
+			return 0, fmt.Errorf("failed invalidate cache of '%s': %v", table, err)
+		}
+	}
+
+	_, err = d.db.ExecContext(ctx, `
+		insert into reencryption (key_id, completed_at) values ($1, now()) on conflict do nothing;
+	`, r.CurrentKeyID())
+	if err != nil {
+		return 0, fmt.Errorf("failed set reencryption marker: %v", err)
+	}
+	return reencryptDone, nil
+}
+
+func (d *dbStorage) reencryptTable(ctx context.Context, r serializer.Reencrypter, table string) error {
+	var last string
+	for {
+		var rows []struct {
+			UID  string `db:"uid"`
+			Data []byte `db:"data"`
+		}
+		err := d.db.SelectContext(ctx, &rows, strings.ReplaceAll(`
+			select uid, data from table where uid > $1 order by uid limit $2;
+		`, "table", table), last, reencryptBatch)
+		if err != nil {
+			return fmt.Errorf("failed select records: %v", err)
+		}
+
+		for _, row := range rows {
+			data, ok, err := r.Reencrypt(row.Data)
+			if err != nil {
+				return fmt.Errorf("failed reencrypt '%s': %v", row.UID, err)
+			}
+			if !ok {
+				continue
+			}
+			// record changed concurrently is already encrypted by current key
+			_, err = d.db.ExecContext(ctx, strings.ReplaceAll(`
+				update table set data = $1 where uid = $2 and data = $3;
+			`, "table", table), data, row.UID, row.Data)
+			if err != nil {
+				return fmt.Errorf("failed update '%s': %v", row.UID, err)
+			}
+		}
+
+		if len(rows) < reencryptBatch {
+			return nil
+		}
+		last = rows[len(rows)-1].UID
+	}
+}
@@ -0,0 +1,215 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/kjushka/microservice-gen/internal/closer"
+	"github.com/kjushka/microservice-gen/internal/config"
+	"github.com/kjushka/microservice-gen/internal/logger"
+)
+
+const (
+	replicaCheckInterval = time.Second
+	// pinsPruneSize is count of pinned callers after which expired pins are removed
+	pinsPruneSize = 10000
+)
+
+type callerKey struct{}
+
+// WithCaller marks ctx with caller identity, reads of caller go to primary
+// for read-your-writes window after its write. Pins are local to instance, caller must
+// stay on instance which served its write to read it for sure
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+func callerFromContext(ctx context.Context) (string, bool) {
+	caller, ok := ctx.Value(callerKey{}).(string)
+	return caller, ok && caller != ""
+}
+
+type replica struct {
+	addr string
+	db   *sqlx.DB
+	// lagging or unavailable replica doesn't serve reads
+	healthy atomic.Bool
+}
+
+// replicaSet balances reads over healthy replicas, reads go to primary if there is no one
+type replicaSet struct {
+	primary  *sqlx.DB
+	replicas []*replica
+	next     atomic.Uint64
+	maxLag   time.Duration
+
+	// zero window means read-your-writes is disabled
+	pinWindow time.Duration
+	mu        sync.Mutex
+	// caller -> time until which its reads go to primary, pins are local to instance
+	pins map[string]time.Time
+}
+
+func newReplicaSet(ctx context.Context, primary *sqlx.DB, cfg *config.Config) (*replicaSet, error) {
+	rs := &replicaSet{
+		primary:   primary,
+		maxLag:    cfg.DBReplicaMaxLag,
+		pinWindow: cfg.DBReadYourWritesWindow,
+		pins:      make(map[string]time.Time),
+	}
+
+	for _, server := range cfg.DBReplicas {
+		db, err := sqlx.Open("postgres", fmt.Sprintf(
+			"postgres://%s:%s@%s:%s/%s?sslmode=disable",
+			server.User,
+			server.Password,
+			server.Host,
+			server.Port,
+			server.Database,
+		))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't connect with replica %s: %v", server.Host, err)
+		}
+		if server.PoolSize > 0 {
+			db.SetMaxOpenConns(server.PoolSize)
+		}
+		closer.Add(db.Close)
+
+		rs.replicas = append(rs.replicas, &replica{addr: fmt.Sprintf("%s:%s", server.Host, server.Port), db: db})
+	}
+	// unavailable replicas are ejected till the next check, they don't block start
+	rs.check(ctx)
+
+	return rs, nil
+}
+
+// reader returns db for read of caller from ctx
+func (rs *replicaSet) reader(ctx context.Context) *sqlx.DB {
+	if len(rs.replicas) == 0 || rs.pinned(ctx) {
+		return rs.primary
+	}
+
+	start := rs.next.Add(1)
+	for i := range rs.replicas {
+		r := rs.replicas[(start+uint64(i))%uint64(len(rs.replicas))]
+		if r.healthy.Load() {
+			return r.db
+		}
+	}
+	return rs.primary
+}
+
+// wrote pins caller from ctx to primary for read-your-writes window
+func (rs *replicaSet) wrote(ctx context.Context) {
+	caller, ok := callerFromContext(ctx)
+	if !ok || rs.pinWindow <= 0 || len(rs.replicas) == 0 {
+		return
+	}
+
+	now := time.Now()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if len(rs.pins) >= pinsPruneSize {
+		for c, until := range rs.pins {
+			if until.Before(now) {
+				delete(rs.pins, c)
+			}
+		}
+	}
+	rs.pins[caller] = now.Add(rs.pinWindow)
+}
+
+func (rs *replicaSet) pinned(ctx context.Context) bool {
+	caller, ok := callerFromContext(ctx)
+	if !ok || rs.pinWindow <= 0 {
+		return false
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	until, ok := rs.pins[caller]
+	if ok && until.Before(time.Now()) {
+		delete(rs.pins, caller)
+		return false
+	}
+	return ok
+}
+
+// RunReplicaMonitor ejects replicas lagging more than max lag and returns caught up ones
+func (d *dbStorage) RunReplicaMonitor(ctx context.Context) {
+	if len(d.replicas.replicas) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(replicaCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		d.replicas.check(ctx)
+	}
+}
+
+func (rs *replicaSet) check(ctx context.Context) {
+	for _, r := range rs.replicas {
+		lag, err := replicationLag(ctx, r.db)
+		healthy := err == nil && lag <= rs.maxLag
+
+		if r.healthy.Swap(healthy) == healthy {
+			continue
+		}
+		if healthy {
+			logger.InfoKV(ctx, "replica returned to reads", "replica", r.addr, "lag", lag)
+			continue
+		}
+		if err != nil {
+			logger.WarnKV(ctx, "replica ejected from reads", "replica", r.addr, "error", err)
+		} else {
+			logger.WarnKV(ctx, "replica ejected from reads", "replica", r.addr, "lag", lag)
+		}
+	}
+}
+
+// replicationLag is age of the last replayed transaction. Replica which replayed everything it
+// received isn't lagging, otherwise replay timestamp grows while primary has no writes. Replica without
+// streaming wal receiver replays nothing new however old its data is, so it isn't healthy at any lag.
+// User needs pg_read_all_stats role to see receiver status, otherwise replicas are always ejected
+func replicationLag(ctx context.Context, db *sqlx.DB) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, replicaCheckInterval)
+	defer cancel()
+
+	var (
+		streaming bool
+		lag       sql.NullFloat64
+	)
+	err := db.QueryRowContext(ctx, `
+		select
+			exists(select 1 from pg_stat_wal_receiver where status = 'streaming'),
+			case
+				when pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() then 0
+				else extract(epoch from now() - pg_last_xact_replay_timestamp())
+			end;
+	`).Scan(&streaming, &lag)
+	if err != nil {
+		return 0, fmt.Errorf("failed get replication lag: %v", err)
+	}
+	if !streaming {
+		return 0, fmt.Errorf("wal receiver isn't streaming from primary")
+	}
+	// null if server isn't replica or didn't replay anything yet
+	if !lag.Valid {
+		return 0, fmt.Errorf("server doesn't replay transactions")
+	}
+
+	return time.Duration(lag.Float64 * float64(time.Second)), nil
+}
@@ -0,0 +1,106 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kjushka/microservice-gen/internal/logger"
+	"github.com/kjushka/microservice-gen/internal/storage"
+)
+
+const sweepBatch = 1000
+
+func (d *dbStorage) RunSweeper(ctx context.Context) {
+	ticker := time.NewTicker(d.sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := d.sweep(ctx)
+		if err != nil {
+			logger.ErrorKV(ctx, "failed sweep expired records", "error", err)
+		}
+	}
+}
+
+func (d *dbStorage) sweep(ctx context.Context) error {
+	ctx, span := d.tracer.Start(ctx, "sweep db")
+	defer span.End()
+
+	// every table with expires_at column is sweepable
+	var tables []string
+	err := d.db.SelectContext(ctx, &tables, `
+		select table_name from information_schema.columns
+		where column_name = 'expires_at' and table_schema = current_schema();
+	`)
+	if err != nil {
+		return fmt.Errorf("failed get tables: %v", err)
+	}
+
+	for _, table := range tables {
+		for {
+			removed, err := d.sweepTable(ctx, table)
+			if err != nil {
+				return fmt.Errorf("failed sweep '%s': %v", table, err)
+			}
+			if removed < sweepBatch {
+				break
+			}
+		}
+	}
+
+	_, err = d.db.ExecContext(ctx, `
+		delete from storage_events where created_at < now() - $1 * interval '1 millisecond';
+	`, d.eventsRetention.Milliseconds())
+	if err != nil {
+		return fmt.Errorf("failed remove old events: %v", err)
+	}
+
+	return nil
+}
+
+// sweepTable removes one batch of expired records and publishes delete events for them
+func (d *dbStorage) sweepTable(ctx context.Context, table string) (int64, error) {
+	tx, err := d.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed begin transaction: %v", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// transaction id must be assigned before revisions, see publishEvent
+	_, err = tx.ExecContext(ctx, `select pg_current_xact_id();`)
+	if err != nil {
+		return 0, fmt.Errorf("failed assign transaction id: %v", err)
+	}
+
+	res, err := tx.ExecContext(ctx, strings.ReplaceAll(`
+		with expired as (
+			delete from table
+			where uid in (select uid from table where expires_at <= now() limit $1)
+			returning uid
+		)
+		insert into storage_events (tbl, uid, type)
+		select $2, uid, $3 from expired;
+	`, "table", table), sweepBatch, table, storage.EventDelete)
+	if err != nil {
+		return 0, fmt.Errorf("failed remove expired records: %v", err)
+	}
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed get affected rows: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("failed commit transaction: %v", err)
+	}
+
+	return removed, nil
+}
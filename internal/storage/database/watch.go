@@ -0,0 +1,326 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/kjushka/microservice-gen/internal/closer"
+	"github.com/kjushka/microservice-gen/internal/logger"
+	"github.com/kjushka/microservice-gen/internal/storage"
+	"github.com/lib/pq"
+)
+
+const (
+	eventsChannel = "storage_events"
+
+	eventsReplayBatch    = 1000
+	subscriberBufferSize = 256
+	// eventsPollInterval is how often watcher checks whether transactions holding back events are finished
+	eventsPollInterval = 100 * time.Millisecond
+)
+
+// publishEvent must be called in the same transaction before the change, returned revision
+// is revision of changed record. Notification is delivered by storage_events trigger after commit.
+// Transactions aren't serialized, so revisions can be committed out of order. Transaction id is
+// assigned before revision, watchers rely on it to tell when revisions become final
+func publishEvent(ctx context.Context, tx *sqlx.Tx, eventType storage.EventType, table string, key string) (int64, error) {
+	_, err := tx.ExecContext(ctx, `select pg_current_xact_id();`)
+	if err != nil {
+		return 0, fmt.Errorf("failed assign transaction id: %v", err)
+	}
+
+	var revision int64
+	err = tx.QueryRowContext(ctx, `
+		insert into storage_events (tbl, uid, type)
+		values ($1, $2, $3) returning revision;
+	`, table, key, eventType).Scan(&revision)
+	if err != nil {
+		return 0, fmt.Errorf("failed insert event: %v", err)
+	}
+
+	return revision, nil
+}
+
+// Watch sends only final events, so event committed later can't get revision below sent one.
+// Live notifications just wake watcher up, events are read from table in revision order.
+// Any long transaction of database delays events until it is finished
+func (d *dbStorage) Watch(ctx context.Context, table string, prefix string, fromRevision int64, fn func(storage.Event) error) error {
+	ch, err := d.events.subscribe(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { d.events.unsubscribe(ch) }()
+
+	last := fromRevision
+	if last == 0 {
+		err = d.db.QueryRowContext(ctx, `select coalesce(max(revision), 0) from storage_events;`).Scan(&last)
+		if err != nil {
+			return fmt.Errorf("failed get last revision: %v", err)
+		}
+	} else {
+		err = d.checkRetained(ctx, fromRevision)
+		if err != nil {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(eventsPollInterval)
+	defer ticker.Stop()
+
+	var marks []finalMark
+	for {
+		var final int64
+		final, marks, err = d.finalRevision(ctx, marks, last)
+		if err != nil {
+			return err
+		}
+		if final > last {
+			last, err = d.replayEvents(ctx, table, prefix, last, final, fn)
+			if err != nil {
+				return err
+			}
+		}
+
+		ch, err = d.awaitEvents(ctx, ch, table, prefix, last, len(marks) > 0, ticker.C)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// checkRetained returns ErrCompacted if events after revision could be removed by retention.
+// Removed events of deletes without record leave gaps too, so resume next to such gap is refused as well
+func (d *dbStorage) checkRetained(ctx context.Context, revision int64) error {
+	var oldest int64
+	err := d.db.QueryRowContext(ctx, `
+		select coalesce(min(revision), (select last_value + 1 from storage_events_revision_seq))
+		from storage_events;
+	`).Scan(&oldest)
+	if err != nil {
+		return fmt.Errorf("failed get oldest revision: %v", err)
+	}
+	if revision < oldest-1 {
+		return fmt.Errorf("watch from revision %d, oldest retained is %d: %w", revision, oldest, storage.ErrCompacted)
+	}
+	return nil
+}
+
+// finalMark is value of revisions sequence read before snapshot with given xmax was taken.
+// Revisions up to it are final when every transaction below xmax is finished
+type finalMark struct {
+	xmax     int64
+	revision int64
+}
+
+// finalRevision returns the highest final revision and marks which aren't final yet, marks not above last are dropped
+func (d *dbStorage) finalRevision(ctx context.Context, marks []finalMark, last int64) (int64, []finalMark, error) {
+	var mark finalMark
+	err := d.db.QueryRowContext(ctx, `select last_value from storage_events_revision_seq;`).Scan(&mark.revision)
+	if err != nil {
+		return 0, marks, fmt.Errorf("failed get revisions sequence: %v", err)
+	}
+	// snapshot is taken after sequence is read, so transaction of every read revision is below its xmax
+	var xmin int64
+	err = d.db.QueryRowContext(ctx, `
+		select pg_snapshot_xmin(s)::text::bigint, pg_snapshot_xmax(s)::text::bigint
+		from pg_current_snapshot() s;
+	`).Scan(&xmin, &mark.xmax)
+	if err != nil {
+		return 0, marks, fmt.Errorf("failed get snapshot: %v", err)
+	}
+	// older mark of the same revision becomes final first
+	if len(marks) == 0 || marks[len(marks)-1].revision < mark.revision {
+		marks = append(marks, mark)
+	}
+
+	var final int64
+	pending := marks[:0]
+	for _, m := range marks {
+		switch {
+		case m.xmax <= xmin:
+			if m.revision > final {
+				final = m.revision
+			}
+		case m.revision > last:
+			pending = append(pending, m)
+		}
+	}
+	return final, pending, nil
+}
+
+// replayEvents sends stored events after revision up to final one and returns last sent revision
+func (d *dbStorage) replayEvents(
+	ctx context.Context,
+	table string,
+	prefix string,
+	revision int64,
+	final int64,
+	fn func(storage.Event) error,
+) (int64, error) {
+	for {
+		var events []storage.Event
+		err := d.db.SelectContext(ctx, &events, `
+			select revision, tbl as "table", uid as "key", type
+			from storage_events
+			where tbl = $1 and starts_with(uid, $2) and revision > $3 and revision <= $4
+			order by revision
+			limit $5;
+		`, table, prefix, revision, final, eventsReplayBatch)
+		if err != nil {
+			return revision, fmt.Errorf("failed select events: %v", err)
+		}
+
+		for _, event := range events {
+			err = fn(event)
+			if err != nil {
+				return revision, err
+			}
+			revision = event.Revision
+		}
+
+		if len(events) < eventsReplayBatch {
+			// events of other tables up to final one mustn't be read again
+			return final, nil
+		}
+	}
+}
+
+// awaitEvents waits for live event of watched keys after last, or for tick if some revisions aren't final yet.
+// Dropped subscription is renewed, events missed meanwhile are read from table by caller
+func (d *dbStorage) awaitEvents(
+	ctx context.Context,
+	ch chan storage.Event,
+	table string,
+	prefix string,
+	last int64,
+	pending bool,
+	tick <-chan time.Time,
+) (chan storage.Event, error) {
+	if !pending {
+		tick = nil
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ch, ctx.Err()
+		case <-tick:
+			return ch, nil
+		case event, ok := <-ch:
+			if !ok {
+				return d.events.subscribe(ctx)
+			}
+			if event.Revision > last && event.Table == table && strings.HasPrefix(event.Key, prefix) {
+				return ch, nil
+			}
+		}
+	}
+}
+
+// eventHub shares one LISTEN connection between all watchers
+type eventHub struct {
+	connStr string
+
+	once     sync.Once
+	startErr error
+
+	mu   sync.Mutex
+	subs map[chan storage.Event]struct{}
+}
+
+func newEventHub(connStr string) *eventHub {
+	return &eventHub{
+		connStr: connStr,
+		subs:    make(map[chan storage.Event]struct{}),
+	}
+}
+
+func (h *eventHub) start(ctx context.Context) error {
+	h.once.Do(func() {
+		listener := pq.NewListener(h.connStr, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				logger.ErrorKV(ctx, "events listener failure", "event", event, "error", err)
+			}
+		})
+		h.startErr = listener.Listen(eventsChannel)
+		if h.startErr != nil {
+			_ = listener.Close()
+			return
+		}
+		closer.Add(listener.Close)
+
+		go h.run(ctx, listener)
+	})
+	return h.startErr
+}
+
+func (h *eventHub) run(ctx context.Context, listener *pq.Listener) {
+	for n := range listener.NotificationChannel() {
+		// nil notification means connection was reestablished and some events may be lost
+		if n == nil {
+			h.dropAll()
+			continue
+		}
+
+		var event storage.Event
+		err := json.Unmarshal([]byte(n.Extra), &event)
+		if err != nil {
+			logger.ErrorKV(ctx, "failed decode event", "payload", n.Extra, "error", err)
+			continue
+		}
+		h.broadcast(event)
+	}
+}
+
+// subscribe returns channel with live events, channel is closed when
+// subscriber can miss events: on listener reconnect or on buffer overflow
+func (h *eventHub) subscribe(ctx context.Context) (chan storage.Event, error) {
+	err := h.start(logger.WithName(context.Background(), "events"))
+	if err != nil {
+		return nil, fmt.Errorf("failed listen events: %v", err)
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ch := make(chan storage.Event, subscriberBufferSize)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, nil
+}
+
+func (h *eventHub) unsubscribe(ch chan storage.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+func (h *eventHub) broadcast(event storage.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- event:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (h *eventHub) dropAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
@@ -0,0 +1,41 @@
+package serializer
+
+import (
+	"io"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	CBORSerializerName         = "cbor"
+	cborSerializationFlag byte = 0x04
+)
+
+type CBORSerializer struct {
+	encMode cbor.EncMode
+}
+
+func NewCBORSerializer() *CBORSerializer {
+	// canonical mode sorts map keys, so equal values have equal blobs
+	encMode, err := cbor.CanonicalEncOptions().EncMode()
+	if err != nil {
+		panic(err)
+	}
+	return &CBORSerializer{encMode: encMode}
+}
+
+func (s *CBORSerializer) Name() string {
+	return CBORSerializerName
+}
+
+func (s *CBORSerializer) SerializationFlag() byte {
+	return cborSerializationFlag
+}
+
+func (s *CBORSerializer) Encode(w io.Writer, value any) error {
+	return s.encMode.NewEncoder(w).Encode(value)
+}
+
+func (s *CBORSerializer) Decode(r io.Reader, destination any) error {
+	return cbor.NewDecoder(r).Decode(destination)
+}
@@ -0,0 +1,135 @@
+package serializer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// NoCompression disables compression of new blobs, compressed ones are still readable
+const NoCompression = "none"
+
+// compression flags follow serialization flags in header
+const (
+	gzipCompressionFlag   byte = 0x10
+	snappyCompressionFlag byte = 0x11
+	zstdCompressionFlag   byte = 0x12
+)
+
+type compressor struct {
+	name      string
+	newWriter func(w io.Writer) (io.WriteCloser, error)
+	newReader func(r io.Reader) (io.Reader, error)
+}
+
+var compressors = map[byte]compressor{
+	gzipCompressionFlag: {
+		name: "gzip",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		newReader: func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	snappyCompressionFlag: {
+		name: "snappy",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return snappy.NewBufferedWriter(w), nil
+		},
+		newReader: func(r io.Reader) (io.Reader, error) {
+			return snappy.NewReader(r), nil
+		},
+	},
+	// single goroutine coders: blobs are small and decoders are never closed,
+	// concurrent ones would leave background goroutines behind
+	zstdCompressionFlag: {
+		name: "zstd",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		},
+		newReader: func(r io.Reader) (io.Reader, error) {
+			return zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		},
+	},
+}
+
+// WithCompression compresses blobs of s which are not less than threshold bytes,
+// small blobs are stored as is. Blobs compressed by any known algorithm are decoded
+func WithCompression(s Serializer, compression string, threshold int) (Serializer, error) {
+	cs := &compressSerializer{Serializer: s, threshold: threshold}
+	if compression == NoCompression {
+		return cs, nil
+	}
+	for flag, c := range compressors {
+		if c.name == compression {
+			cs.flag = flag
+			return cs, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown compression '%s'", compression)
+}
+
+type compressSerializer struct {
+	Serializer
+	// zero if new blobs aren't compressed
+	flag      byte
+	threshold int
+}
+
+func (s *compressSerializer) Encode(w io.Writer, value any) error {
+	if s.flag == 0 {
+		return s.Serializer.Encode(w, value)
+	}
+
+	buf := &bytes.Buffer{}
+	err := s.Serializer.Encode(buf, value)
+	if err != nil {
+		return err
+	}
+	if buf.Len() < s.threshold {
+		_, err = buf.WriteTo(w)
+		return err
+	}
+
+	err = writeHeader(w, s.flag)
+	if err != nil {
+		return err
+	}
+	cw, err := compressors[s.flag].newWriter(w)
+	if err != nil {
+		return fmt.Errorf("failed compress: %v", err)
+	}
+	_, err = buf.WriteTo(cw)
+	if err != nil {
+		return fmt.Errorf("failed compress: %v", err)
+	}
+	err = cw.Close()
+	if err != nil {
+		return fmt.Errorf("failed compress: %v", err)
+	}
+	return nil
+}
+
+func (s *compressSerializer) Decode(r io.Reader, destination any) error {
+	br, flag, ok, err := peekHeader(r)
+	if err != nil {
+		return err
+	}
+
+	c, compressed := compressors[flag]
+	if !ok || !compressed {
+		return s.Serializer.Decode(br, destination)
+	}
+
+	_, _ = br.Discard(2)
+	cr, err := c.newReader(br)
+	if err != nil {
+		return fmt.Errorf("failed decompress: %v", err)
+	}
+	return s.Serializer.Decode(cr, destination)
+}
@@ -0,0 +1,133 @@
+package serializer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func newTestCompression(t *testing.T, compression string, threshold int) Serializer {
+	t.Helper()
+	s, err := New(JSONSerializerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = WithCompression(s, compression, threshold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCompression(t *testing.T) {
+	large := testValue{Name: strings.Repeat("compressible ", 100), Count: 1}
+	small := testValue{Name: "small", Count: 2}
+	const threshold = 256
+
+	plain, err := New(JSONSerializerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		compression string
+		flag        byte
+	}{
+		{compression: "gzip", flag: gzipCompressionFlag},
+		{compression: "snappy", flag: snappyCompressionFlag},
+		{compression: "zstd", flag: zstdCompressionFlag},
+	}
+	for _, tt := range tests {
+		t.Run(tt.compression, func(t *testing.T) {
+			s := newTestCompression(t, tt.compression, threshold)
+
+			t.Run("round trip", func(t *testing.T) {
+				blob := encode(t, s, large)
+				if blob[0] != headerMagic || blob[1] != tt.flag {
+					t.Fatalf("blob header is %x, want %x", blob[:2], []byte{headerMagic, tt.flag})
+				}
+				if len(blob) >= len(encode(t, plain, large)) {
+					t.Fatal("blob isn't compressed")
+				}
+				got, err := decode(s, blob)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != large {
+					t.Fatalf("decoded %v, want %v", got, large)
+				}
+			})
+
+			t.Run("small blob is stored as is", func(t *testing.T) {
+				blob := encode(t, s, small)
+				if !bytes.Equal(blob, encode(t, plain, small)) {
+					t.Fatalf("blob below threshold is changed: %x", blob)
+				}
+				got, err := decode(s, blob)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != small {
+					t.Fatalf("decoded %v, want %v", got, small)
+				}
+			})
+
+			t.Run("not compressed blob is readable", func(t *testing.T) {
+				got, err := decode(s, encode(t, plain, large))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != large {
+					t.Fatalf("decoded %v, want %v", got, large)
+				}
+			})
+
+			t.Run("headerless message pack blob is readable", func(t *testing.T) {
+				blob := encode(t, NewMessagePackSerializer(), large)
+				got, err := decode(s, blob)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != large {
+					t.Fatalf("decoded %v, want %v", got, large)
+				}
+			})
+
+			for _, other := range tests {
+				t.Run("blob of "+other.compression+" is readable", func(t *testing.T) {
+					blob := encode(t, newTestCompression(t, other.compression, threshold), large)
+					got, err := decode(s, blob)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got != large {
+						t.Fatalf("decoded %v, want %v", got, large)
+					}
+				})
+			}
+		})
+	}
+
+	t.Run("none keeps blobs as is and reads compressed ones", func(t *testing.T) {
+		s := newTestCompression(t, NoCompression, 0)
+		if !bytes.Equal(encode(t, s, large), encode(t, plain, large)) {
+			t.Fatal("blob is changed without compression")
+		}
+		for _, tt := range tests {
+			got, err := decode(s, encode(t, newTestCompression(t, tt.compression, 0), large))
+			if err != nil {
+				t.Fatalf("failed decode %s blob: %v", tt.compression, err)
+			}
+			if got != large {
+				t.Fatalf("decoded %v, want %v", got, large)
+			}
+		}
+	})
+
+	t.Run("unknown compression", func(t *testing.T) {
+		_, err := WithCompression(plain, "lz4", threshold)
+		if err == nil {
+			t.Fatal("unknown compression is accepted")
+		}
+	})
+}
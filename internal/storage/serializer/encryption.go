@@ -0,0 +1,224 @@
+package serializer
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+const encryptionFlag byte = 0x20
+
+const (
+	masterKeySize = 32
+	dataKeySize   = 32
+	nonceSize     = 12
+	// header with key id is authenticated together with data
+	encryptionHeaderSize = 2 + 4
+	wrappedDataKeySize   = nonceSize + dataKeySize + 16
+)
+
+// Keyring holds master keys from keyfile, every blob is encrypted by its own data key
+// which is wrapped by current master key and stored in blob with master key id.
+//
+// Keyfile format is {"current_key_id": 2, "keys": [{"id": 1, "key": "<base64>"}, {"id": 2, "key": "<base64>"}]}.
+// Records written before encryption was enabled are encrypted by instance started with STORAGE_REENCRYPT_ON_START.
+// To rotate key add new one and make it current, old keys are needed until such instance reencrypts records
+type Keyring struct {
+	currentID uint32
+	keys      map[uint32]cipher.AEAD
+}
+
+type keyfile struct {
+	CurrentKeyID uint32 `json:"current_key_id"`
+	Keys         []struct {
+		ID  uint32 `json:"id"`
+		Key string `json:"key"`
+	} `json:"keys"`
+}
+
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed read keyfile: %v", err)
+	}
+	var kf keyfile
+	err = json.Unmarshal(data, &kf)
+	if err != nil {
+		return nil, fmt.Errorf("failed parse keyfile: %v", err)
+	}
+
+	keyring := &Keyring{
+		currentID: kf.CurrentKeyID,
+		keys:      make(map[uint32]cipher.AEAD, len(kf.Keys)),
+	}
+	for _, k := range kf.Keys {
+		key, err := base64.StdEncoding.DecodeString(k.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed decode key %d: %v", k.ID, err)
+		}
+		if len(key) != masterKeySize {
+			return nil, fmt.Errorf("key %d must be %d bytes", k.ID, masterKeySize)
+		}
+		keyring.keys[k.ID], err = newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed create cipher for key %d: %v", k.ID, err)
+		}
+	}
+	if _, ok := keyring.keys[kf.CurrentKeyID]; !ok {
+		return nil, fmt.Errorf("current key %d not found in keyfile", kf.CurrentKeyID)
+	}
+
+	return keyring, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Reencrypter is implemented by serializer with encryption
+type Reencrypter interface {
+	// CurrentKeyID is id of master key new blobs are encrypted with
+	CurrentKeyID() uint32
+	// Reencrypt returns blob encrypted by current key, ok is false if blob is already encrypted by it.
+	// Not encrypted blob is encrypted
+	Reencrypt(blob []byte) (result []byte, ok bool, err error)
+}
+
+// WithEncryption encrypts blobs of s with AES-GCM, not encrypted blobs are still readable
+func WithEncryption(s Serializer, keyring *Keyring) Serializer {
+	return &encryptSerializer{Serializer: s, keyring: keyring}
+}
+
+type encryptSerializer struct {
+	Serializer
+	keyring *Keyring
+}
+
+func (s *encryptSerializer) Encode(w io.Writer, value any) error {
+	buf := &bytes.Buffer{}
+	err := s.Serializer.Encode(buf, value)
+	if err != nil {
+		return err
+	}
+
+	blob, err := s.seal(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(blob)
+	return err
+}
+
+func (s *encryptSerializer) Decode(r io.Reader, destination any) error {
+	br, flag, ok, err := peekHeader(r)
+	if err != nil {
+		return err
+	}
+	if !ok || flag != encryptionFlag {
+		return s.Serializer.Decode(br, destination)
+	}
+
+	blob, err := io.ReadAll(br)
+	if err != nil {
+		return fmt.Errorf("failed read encrypted blob: %v", err)
+	}
+	plain, _, err := s.open(blob)
+	if err != nil {
+		return err
+	}
+	return s.Serializer.Decode(bytes.NewReader(plain), destination)
+}
+
+func (s *encryptSerializer) CurrentKeyID() uint32 {
+	return s.keyring.currentID
+}
+
+func (s *encryptSerializer) Reencrypt(blob []byte) ([]byte, bool, error) {
+	plain := blob
+	if len(blob) >= 2 && blob[0] == headerMagic && blob[1] == encryptionFlag {
+		var (
+			keyID uint32
+			err   error
+		)
+		plain, keyID, err = s.open(blob)
+		if err != nil {
+			return nil, false, err
+		}
+		if keyID == s.keyring.currentID {
+			return blob, false, nil
+		}
+	}
+
+	result, err := s.seal(plain)
+	if err != nil {
+		return nil, false, err
+	}
+	return result, true, nil
+}
+
+// seal returns blob: header, master key id, wrapped data key, nonce, encrypted data
+func (s *encryptSerializer) seal(plain []byte) ([]byte, error) {
+	header := make([]byte, encryptionHeaderSize)
+	header[0], header[1] = headerMagic, encryptionFlag
+	binary.BigEndian.PutUint32(header[2:], s.keyring.currentID)
+
+	dataKey := make([]byte, dataKeySize+2*nonceSize)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed generate data key: %v", err)
+	}
+	dataKey, wrapNonce, nonce := dataKey[:dataKeySize], dataKey[dataKeySize:dataKeySize+nonceSize], dataKey[dataKeySize+nonceSize:]
+
+	blob := make([]byte, 0, encryptionHeaderSize+wrappedDataKeySize+nonceSize+len(plain)+16)
+	blob = append(blob, header...)
+	blob = append(blob, wrapNonce...)
+	blob = s.keyring.keys[s.keyring.currentID].Seal(blob, wrapNonce, dataKey, header)
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed create data cipher: %v", err)
+	}
+	blob = append(blob, nonce...)
+	return aead.Seal(blob, nonce, plain, header), nil
+}
+
+// open returns decrypted data and id of master key it was encrypted with
+func (s *encryptSerializer) open(blob []byte) ([]byte, uint32, error) {
+	if len(blob) < encryptionHeaderSize+wrappedDataKeySize+nonceSize {
+		return nil, 0, fmt.Errorf("encrypted blob is too short")
+	}
+	header := blob[:encryptionHeaderSize]
+	keyID := binary.BigEndian.Uint32(header[2:])
+	masterKey, ok := s.keyring.keys[keyID]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown encryption key %d", keyID)
+	}
+
+	wrapped := blob[encryptionHeaderSize : encryptionHeaderSize+wrappedDataKeySize]
+	dataKey, err := masterKey.Open(nil, wrapped[:nonceSize], wrapped[nonceSize:], header)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed unwrap data key: %v", err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed create data cipher: %v", err)
+	}
+
+	rest := blob[encryptionHeaderSize+wrappedDataKeySize:]
+	plain, err := aead.Open(nil, rest[:nonceSize], rest[nonceSize:], header)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed decrypt: %v", err)
+	}
+	return plain, keyID, nil
+}
@@ -0,0 +1,253 @@
+package serializer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testValue struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+var testKeys = [][]byte{
+	bytes.Repeat([]byte{1}, masterKeySize),
+	bytes.Repeat([]byte{2}, masterKeySize),
+}
+
+// newTestEncryption returns serializer with keys 1 and 2 from testKeys, current is currentID
+func newTestEncryption(t *testing.T, currentID uint32) *encryptSerializer {
+	t.Helper()
+	keys := make([]string, 0, len(testKeys))
+	for i, key := range testKeys {
+		keys = append(keys, fmt.Sprintf(`{"id": %d, "key": "%s"}`, i+1, base64.StdEncoding.EncodeToString(key)))
+	}
+	path := filepath.Join(t.TempDir(), "keyfile.json")
+	err := os.WriteFile(path, []byte(fmt.Sprintf(`{"current_key_id": %d, "keys": [%s]}`, currentID, strings.Join(keys, ","))), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New("json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return WithEncryption(s, keyring).(*encryptSerializer)
+}
+
+func encode(t *testing.T, s Serializer, value any) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	err := s.Encode(buf, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decode(s Serializer, blob []byte) (testValue, error) {
+	var v testValue
+	err := s.Decode(bytes.NewReader(blob), &v)
+	return v, err
+}
+
+func TestEncryption(t *testing.T) {
+	value := testValue{Name: "secret", Count: 42}
+
+	t.Run("round trip", func(t *testing.T) {
+		s := newTestEncryption(t, 1)
+		blob := encode(t, s, value)
+		if bytes.Contains(blob, []byte("secret")) {
+			t.Fatal("blob contains plain value")
+		}
+		if blob[0] != headerMagic || blob[1] != encryptionFlag {
+			t.Fatalf("blob header is %x, want encryption header", blob[:2])
+		}
+		got, err := decode(s, blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != value {
+			t.Fatalf("decoded %v, want %v", got, value)
+		}
+	})
+
+	t.Run("every blob has own data key", func(t *testing.T) {
+		s := newTestEncryption(t, 1)
+		if bytes.Equal(encode(t, s, value), encode(t, s, value)) {
+			t.Fatal("same value is encrypted to same blob")
+		}
+	})
+
+	t.Run("old key is readable after rotation", func(t *testing.T) {
+		blob := encode(t, newTestEncryption(t, 1), value)
+		got, err := decode(newTestEncryption(t, 2), blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != value {
+			t.Fatalf("decoded %v, want %v", got, value)
+		}
+	})
+
+	t.Run("not encrypted blob is readable", func(t *testing.T) {
+		plain, err := New("json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decode(newTestEncryption(t, 1), encode(t, plain, value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != value {
+			t.Fatalf("decoded %v, want %v", got, value)
+		}
+	})
+
+	t.Run("tampered blob fails", func(t *testing.T) {
+		s := newTestEncryption(t, 1)
+		blob := encode(t, s, value)
+		positions := map[string]int{
+			"key id":           encryptionHeaderSize - 1,
+			"wrapped data key": encryptionHeaderSize + nonceSize,
+			"nonce":            encryptionHeaderSize + wrappedDataKeySize,
+			"data":             len(blob) - 1,
+		}
+		for name, pos := range positions {
+			tampered := bytes.Clone(blob)
+			tampered[pos] ^= 0xff
+			_, err := decode(s, tampered)
+			if err == nil {
+				t.Fatalf("blob with tampered %s is decoded", name)
+			}
+		}
+	})
+
+	t.Run("truncated blob fails", func(t *testing.T) {
+		s := newTestEncryption(t, 1)
+		blob := encode(t, s, value)
+		_, err := decode(s, blob[:encryptionHeaderSize+wrappedDataKeySize])
+		if err == nil {
+			t.Fatal("truncated blob is decoded")
+		}
+	})
+
+	t.Run("unknown key fails", func(t *testing.T) {
+		s := newTestEncryption(t, 1)
+		blob := encode(t, s, value)
+		delete(s.keyring.keys, 1)
+		_, err := decode(s, blob)
+		if err == nil {
+			t.Fatal("blob of unknown key is decoded")
+		}
+	})
+}
+
+func TestReencrypt(t *testing.T) {
+	value := testValue{Name: "secret", Count: 42}
+	plain, err := New("json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		blob   func(t *testing.T) []byte
+		wantOk bool
+	}{
+		{
+			name:   "not encrypted",
+			blob:   func(t *testing.T) []byte { return encode(t, plain, value) },
+			wantOk: true,
+		},
+		{
+			name:   "old key",
+			blob:   func(t *testing.T) []byte { return encode(t, newTestEncryption(t, 1), value) },
+			wantOk: true,
+		},
+		{
+			name:   "current key",
+			blob:   func(t *testing.T) []byte { return encode(t, newTestEncryption(t, 2), value) },
+			wantOk: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestEncryption(t, 2)
+			blob := tt.blob(t)
+			result, ok, err := s.Reencrypt(blob)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.wantOk {
+				t.Fatalf("ok is %v, want %v", ok, tt.wantOk)
+			}
+			if !ok && !bytes.Equal(result, blob) {
+				t.Fatal("blob of current key is changed")
+			}
+
+			_, keyID, err := s.open(result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keyID != s.CurrentKeyID() {
+				t.Fatalf("blob is encrypted by key %d, want %d", keyID, s.CurrentKeyID())
+			}
+			got, err := decode(s, result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != value {
+				t.Fatalf("decoded %v, want %v", got, value)
+			}
+		})
+	}
+
+	t.Run("tampered blob fails", func(t *testing.T) {
+		s := newTestEncryption(t, 2)
+		blob := encode(t, newTestEncryption(t, 1), value)
+		blob[len(blob)-1] ^= 0xff
+		_, _, err := s.Reencrypt(blob)
+		if err == nil {
+			t.Fatal("tampered blob is reencrypted")
+		}
+	})
+}
+
+func TestLoadKeyring(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(testKeys[0])
+	short := base64.StdEncoding.EncodeToString(testKeys[0][:masterKeySize/2])
+
+	tests := []struct {
+		name    string
+		keyfile string
+		valid   bool
+	}{
+		{name: "valid", keyfile: `{"current_key_id": 1, "keys": [{"id": 1, "key": "` + key + `"}]}`, valid: true},
+		{name: "current key missing", keyfile: `{"current_key_id": 2, "keys": [{"id": 1, "key": "` + key + `"}]}`},
+		{name: "short key", keyfile: `{"current_key_id": 1, "keys": [{"id": 1, "key": "` + short + `"}]}`},
+		{name: "not base64", keyfile: `{"current_key_id": 1, "keys": [{"id": 1, "key": "?"}]}`},
+		{name: "not json", keyfile: `keys`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keyfile.json")
+			err := os.WriteFile(path, []byte(tt.keyfile), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = LoadKeyring(path)
+			if (err == nil) != tt.valid {
+				t.Fatalf("load error is %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package serializer
+
+import (
+	"encoding/json"
+	"io"
+)
+
+const (
+	JSONSerializerName         = "json"
+	jsonSerializationFlag byte = 0x02
+)
+
+type JSONSerializer struct{}
+
+func NewJSONSerializer() *JSONSerializer {
+	return &JSONSerializer{}
+}
+
+func (s *JSONSerializer) Name() string {
+	return JSONSerializerName
+}
+
+func (s *JSONSerializer) SerializationFlag() byte {
+	return jsonSerializationFlag
+}
+
+func (s *JSONSerializer) Encode(w io.Writer, value any) error {
+	return json.NewEncoder(w).Encode(value)
+}
+
+func (s *JSONSerializer) Decode(r io.Reader, destination any) error {
+	return json.NewDecoder(r).Decode(destination)
+}
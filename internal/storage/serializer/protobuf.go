@@ -0,0 +1,66 @@
+package serializer
+
+import (
+	"fmt"
+	"io"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	ProtobufSerializerName         = "protobuf"
+	protobufSerializationFlag byte = 0x03
+)
+
+// ProtobufSerializer encodes proto messages, raw bytes are written as is
+type ProtobufSerializer struct{}
+
+func NewProtobufSerializer() *ProtobufSerializer {
+	return &ProtobufSerializer{}
+}
+
+func (s *ProtobufSerializer) Name() string {
+	return ProtobufSerializerName
+}
+
+func (s *ProtobufSerializer) SerializationFlag() byte {
+	return protobufSerializationFlag
+}
+
+func (s *ProtobufSerializer) Encode(w io.Writer, value any) error {
+	var (
+		data []byte
+		err  error
+	)
+	switch v := value.(type) {
+	case proto.Message:
+		data, err = proto.Marshal(v)
+		if err != nil {
+			return err
+		}
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("protobuf serializer can't encode %T", value)
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+func (s *ProtobufSerializer) Decode(r io.Reader, destination any) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	switch d := destination.(type) {
+	case proto.Message:
+		return proto.Unmarshal(data, d)
+	case *[]byte:
+		*d = data
+		return nil
+	default:
+		return fmt.Errorf("protobuf serializer can't decode to %T", destination)
+	}
+}
@@ -1,56 +1,124 @@
 package serializer
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 
-	"github.com/vmihailenco/msgpack/v5"
+	"github.com/kjushka/microservice-gen/internal/config"
 )
 
-const (
-	messagePackSerializerName    string = "message-pack"
-	messagePackSerializationFlag uint32 = 1 << iota
-)
+// Serializer encodes values stored in cache and database
+type Serializer interface {
+	Name() string
+	// SerializationFlag is written to header of every blob and identifies serializer on decode
+	SerializationFlag() byte
+	Encode(w io.Writer, value any) error
+	// need send pointer to destination
+	Decode(r io.Reader, destination any) error
+}
 
-type MessagePackSerializer struct{}
+// HeaderMagic starts every blob with header, it is never used by message pack,
+// so blobs written before header was introduced are still readable.
+// Flags below 0x30 are used by serializer, flags from 0x30 are reserved for cache envelope
+const HeaderMagic byte = 0xc1
 
-func NewMessagePackSerializer() *MessagePackSerializer {
-	return &MessagePackSerializer{}
-}
+const headerMagic = HeaderMagic
 
-func (s *MessagePackSerializer) Name() string {
-	return messagePackSerializerName
+var serializers = map[byte]Serializer{}
+
+func register(s Serializer) {
+	serializers[s.SerializationFlag()] = s
 }
 
-func (s *MessagePackSerializer) SerializationFlag() uint32 {
-	return messagePackSerializationFlag
+func init() {
+	register(NewMessagePackSerializer())
+	register(NewJSONSerializer())
+	register(NewProtobufSerializer())
+	register(NewCBORSerializer())
 }
 
-func (s *MessagePackSerializer) Encode(w io.Writer, value any) error {
-	enc := msgpack.NewEncoder(w)
-	enc.UseArrayEncodedStructs(true)
-	enc.SetOmitEmpty(true)
-	enc.SetSortMapKeys(true)
-	enc.UseCompactFloats(true)
-	enc.UseCompactInts(true)
-	return enc.Encode(value)
+// Init returns serializer configured for storages
+func Init(cfg *config.Config) (Serializer, error) {
+	s, err := New(cfg.StorageSerializer)
+	if err != nil {
+		return nil, err
+	}
+	s, err = WithCompression(s, cfg.StorageCompression, cfg.StorageCompressionThreshold)
+	if err != nil {
+		return nil, err
+	}
+	// encryption is the last layer, compressing encrypted data is useless
+	if cfg.StorageEncryptionKeyfile == "" {
+		return s, nil
+	}
+	keyring, err := LoadKeyring(cfg.StorageEncryptionKeyfile)
+	if err != nil {
+		return nil, err
+	}
+	return WithEncryption(s, keyring), nil
 }
 
-func (s *MessagePackSerializer) Decode(r io.Reader, destination any) (err error) {
-	defer func() {
-		if panicErr := recover(); panicErr != nil {
-			err = fmt.Errorf("cannot decode to destination: %v", panicErr)
+// New returns serializer with given name, it writes header with serialization flag
+// before encoded value and decodes blob by any known serializer according to its header
+func New(name string) (Serializer, error) {
+	for _, s := range serializers {
+		if s.Name() == name {
+			return &headerSerializer{s}, nil
 		}
-	}()
-
-	dec := msgpack.NewDecoder(r)
-	dec.SetMapDecoder(func(dec *msgpack.Decoder) (interface{}, error) {
-		return dec.DecodeUntypedMap()
-	})
-	dec.UseLooseInterfaceDecoding(true)
-	err = dec.Decode(destination)
+	}
+	return nil, fmt.Errorf("unknown serializer '%s'", name)
+}
+
+// peekHeader returns flag of blob header, ok is false for blob without header.
+// Returned reader must be used instead of r, layer which handles header must skip it
+func peekHeader(r io.Reader) (br *bufio.Reader, flag byte, ok bool, err error) {
+	br = bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, 0, false, fmt.Errorf("failed read header: %v", err)
+	}
+	if len(header) < 2 || header[0] != headerMagic {
+		return br, 0, false, nil
+	}
+	return br, header[1], true, nil
+}
+
+func writeHeader(w io.Writer, flag byte) error {
+	_, err := w.Write([]byte{headerMagic, flag})
 	if err != nil {
-		return err
+		return fmt.Errorf("failed write header: %v", err)
 	}
 	return nil
 }
+
+type headerSerializer struct {
+	Serializer
+}
+
+func (s *headerSerializer) Encode(w io.Writer, value any) error {
+	err := writeHeader(w, s.SerializationFlag())
+	if err != nil {
+		return err
+	}
+	return s.Serializer.Encode(w, value)
+}
+
+func (s *headerSerializer) Decode(r io.Reader, destination any) error {
+	br, flag, ok, err := peekHeader(r)
+	if err != nil {
+		return err
+	}
+
+	// blob without header is written by message pack serializer
+	if !ok {
+		return serializers[messagePackSerializationFlag].Decode(br, destination)
+	}
+
+	decoder, ok := serializers[flag]
+	if !ok {
+		return fmt.Errorf("unknown serialization flag %#x", flag)
+	}
+	_, _ = br.Discard(2)
+	return decoder.Decode(br, destination)
+}
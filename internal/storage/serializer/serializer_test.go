@@ -0,0 +1,80 @@
+package serializer
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHeader(t *testing.T) {
+	value := []byte("value")
+	names := []string{MessagePackSerializerName, JSONSerializerName, ProtobufSerializerName, CBORSerializerName}
+
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			s, err := New(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			blob := encode(t, s, value)
+			if blob[0] != headerMagic || blob[1] != s.SerializationFlag() {
+				t.Fatalf("blob header is %x, want %x", blob[:2], []byte{headerMagic, s.SerializationFlag()})
+			}
+
+			// blob is decoded according to its header whichever serializer is configured
+			for _, other := range names {
+				reader, err := New(other)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []byte
+				err = reader.Decode(bytes.NewReader(blob), &got)
+				if err != nil {
+					t.Fatalf("failed decode by %s: %v", other, err)
+				}
+				if !bytes.Equal(got, value) {
+					t.Fatalf("%s decoded %q, want %q", other, got, value)
+				}
+			}
+		})
+	}
+
+	t.Run("headerless message pack", func(t *testing.T) {
+		legacy := testValue{Name: "legacy", Count: 7}
+		blob := encode(t, NewMessagePackSerializer(), legacy)
+		if blob[0] == headerMagic {
+			t.Fatalf("message pack blob starts with header magic")
+		}
+		for _, name := range names {
+			s, err := New(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decode(s, blob)
+			if err != nil {
+				t.Fatalf("failed decode by %s: %v", name, err)
+			}
+			if got != legacy {
+				t.Fatalf("%s decoded %v, want %v", name, got, legacy)
+			}
+		}
+	})
+
+	t.Run("unknown flag", func(t *testing.T) {
+		s, err := New(JSONSerializerName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []byte
+		err = s.Decode(bytes.NewReader([]byte{headerMagic, 0x0f, '"', '"'}), &got)
+		if err == nil {
+			t.Fatal("blob of unknown flag is decoded")
+		}
+	})
+
+	t.Run("unknown serializer", func(t *testing.T) {
+		_, err := New("xml")
+		if err == nil {
+			t.Fatal("unknown serializer is created")
+		}
+	})
+}
@@ -0,0 +1,188 @@
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/kjushka/microservice-gen/internal/logger"
+	"github.com/kjushka/microservice-gen/internal/storage"
+	"github.com/kjushka/microservice-gen/internal/storage/serializer"
+)
+
+const (
+	reencryptBatch = 1000
+	// reencryptLockID lets only one instance rewrite records
+	reencryptLockID = 2023061500
+)
+
+// RunReencrypt encrypts records written before encryption was enabled and rewrites records encrypted
+// by old keys. Revisions aren't changed, records values stay the same. Cache keeps blobs of old keys,
+// so cached values of every scanned table are dropped, including ones rewritten by interrupted run.
+// Completed run is marked with current key id, so next starts don't scan tables again.
+// Encryption switched off and on again needs new key id to be reencrypted
+func (d *clusterStorage) RunReencrypt(ctx context.Context, invalidator storage.Invalidator) {
+	r, ok := d.serializer.(serializer.Reencrypter)
+	if !ok {
+		return
+	}
+
+	result, err := d.reencrypt(ctx, r, invalidator)
+	if err != nil {
+		logger.ErrorKV(ctx, "failed reencrypt records", "error", err)
+		return
+	}
+	switch result {
+	case reencryptLocked:
+		logger.InfoKV(ctx, "records are reencrypted by other instance")
+	case reencryptSkipped:
+		logger.InfoKV(ctx, "records are already encrypted by current key", "key", r.CurrentKeyID())
+	default:
+		logger.InfoKV(ctx, "records reencrypted, old keys can be removed from keyfile", "key", r.CurrentKeyID())
+	}
+}
+
+type reencryptResult int
+
+const (
+	reencryptDone reencryptResult = iota
+	// other instance holds the lock
+	reencryptLocked
+	// records were reencrypted by current key before
+	reencryptSkipped
+)
+
+// reencrypt keeps marker of completed run in the first server like resharding does
+func (d *clusterStorage) reencrypt(ctx context.Context, r serializer.Reencrypter, invalidator storage.Invalidator) (reencryptResult, error) {
+	// session lock is bound to connection, so one connection is kept till the end
+	conn := d.markers().Conn()
+	defer func() { _ = conn.Close() }()
+
+	var locked bool
+	_, err := conn.QueryOneContext(ctx, pg.Scan(&locked), `select pg_try_advisory_lock(?);`, reencryptLockID)
+	if err != nil {
+		return 0, fmt.Errorf("failed lock reencryption: %v", err)
+	}
+	if !locked {
+		return reencryptLocked, nil
+	}
+	defer func() {
+		_, _ = conn.ExecContext(context.Background(), `select pg_advisory_unlock(?);`, reencryptLockID)
+	}()
+
+	_, err = d.markers().ExecContext(ctx, `
+		create table if not exists reencryption (
+			key_id       bigint      primary key,
+			completed_at timestamptz not null
+		);
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed create reencryption table: %v", err)
+	}
+	var completed bool
+	_, err = d.markers().QueryOneContext(ctx, pg.Scan(&completed), `
+		select exists(select 1 from reencryption where key_id = ?);
+	`, r.CurrentKeyID())
+	if err != nil {
+		return 0, fmt.Errorf("failed check reencryption marker: %v", err)
+	}
+	if completed {
+		return reencryptSkipped, nil
+	}
+
+	var (
+		mu     sync.Mutex
+		tables = make(map[string]struct{})
+	)
+	err = d.cluster.ForEachShard(func(shard *pg.DB) error {
+		shardTables, err := d.reencryptShard(ctx, r, shard)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, table := range shardTables {
+			tables[table] = struct{}{}
+		}
+		return err
+	})
+	// tables are invalidated even if some shard failed, their records may be rewritten already
+	for table := range tables {
+		ierr := invalidator.InvalidateTable(ctx, table)
+		if ierr != nil && err == nil {
+			err = fmt.Errorf("failed invalidate cache of '%s': %v", table, ierr)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = d.markers().ExecContext(ctx, `
+		insert into reencryption (key_id, completed_at) values (?, now()) on conflict do nothing;
+	`, r.CurrentKeyID())
+	if err != nil {
+		return 0, fmt.Errorf("failed set reencryption marker: %v", err)
+	}
+	return reencryptDone, nil
+}
+
+// reencryptShard returns scanned tables of shard
+func (d *clusterStorage) reencryptShard(ctx context.Context, r serializer.Reencrypter, shard *pg.DB) ([]string, error) {
+	ctx, span := d.tracer.Start(ctx, "reencrypt shard")
+	defer span.End()
+
+	var tables []string
+	_, err := shard.QueryContext(ctx, &tables, `
+		select table_name from information_schema.columns
+		where column_name = 'data' and data_type = 'bytea' and table_schema = 'shard' || ?SHARD_ID;
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed get tables: %v", err)
+	}
+
+	for i, table := range tables {
+		err = d.reencryptTable(ctx, r, shard, table)
+		if err != nil {
+			return tables[:i+1], fmt.Errorf("failed reencrypt '%s': %v", table, err)
+		}
+	}
+
+	return tables, nil
+}
+
+func (d *clusterStorage) reencryptTable(ctx context.Context, r serializer.Reencrypter, shard *pg.DB, table string) error {
+	var last string
+	for {
+		var rows []struct {
+			UID  string
+			Data []byte
+		}
+		_, err := shard.QueryContext(ctx, &rows, strings.ReplaceAll(`
+			select uid, data from ?SHARD.table where uid > ? order by uid limit ?;
+		`, "table", table), last, reencryptBatch)
+		if err != nil {
+			return fmt.Errorf("failed select records: %v", err)
+		}
+
+		for _, row := range rows {
+			data, ok, err := r.Reencrypt(row.Data)
+			if err != nil {
+				return fmt.Errorf("failed reencrypt '%s': %v", row.UID, err)
+			}
+			if !ok {
+				continue
+			}
+			// record changed concurrently is already encrypted by current key
+			_, err = shard.ExecContext(ctx, strings.ReplaceAll(`
+				update ?SHARD.table set data = ? where uid = ? and data = ?;
+			`, "table", table), data, row.UID, row.Data)
+			if err != nil {
+				return fmt.Errorf("failed update '%s': %v", row.UID, err)
+			}
+		}
+
+		if len(rows) < reencryptBatch {
+			return nil
+		}
+		last = rows[len(rows)-1].UID
+	}
+}
@@ -0,0 +1,267 @@
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/kjushka/microservice-gen/internal/logger"
+)
+
+const (
+	// reshardLockID lets only one instance move keys, the others wait for cutover marker
+	reshardLockID   = 2023060200
+	reshardBatch    = 1000
+	reshardInterval = 10 * time.Second
+)
+
+// internalTables of shard schemas belong to their shard, their rows aren't moved with keys
+var internalTables = []string{"storage_events"}
+
+// ReshardingProgress describes online resharding from From to To shards
+type ReshardingProgress struct {
+	From, To int
+	// shards scanned by mover of this instance, zero on instances which don't move keys
+	ShardsDone  int64
+	ShardsTotal int64
+	RowsMoved   int64
+	// keys are routed only by new shards count
+	Completed bool
+}
+
+func (d *clusterStorage) ReshardingProgress() ReshardingProgress {
+	return ReshardingProgress{
+		From:        d.router.from,
+		To:          d.router.to,
+		ShardsDone:  d.shardsDone.Load(),
+		ShardsTotal: int64(len(d.cluster.Shards(nil))),
+		RowsMoved:   d.rowsMoved.Load(),
+		Completed:   !d.router.resharding(),
+	}
+}
+
+// initResharding creates cutover markers table on the first server and
+// skips resharding which was completed before restart
+func (d *clusterStorage) initResharding(ctx context.Context) error {
+	if !d.router.resharding() {
+		return nil
+	}
+
+	_, err := d.markers().ExecContext(ctx, `
+		create table if not exists resharding (
+			from_count   int         not null,
+			to_count     int         not null,
+			completed_at timestamptz not null,
+			primary key (from_count, to_count)
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed create resharding table: %v", err)
+	}
+
+	_, err = d.checkCutover(ctx)
+	return err
+}
+
+func (d *clusterStorage) markers() *pg.DB {
+	return d.cluster.DBs()[0]
+}
+
+// checkCutover switches routing to new shards count if mover has finished.
+// Switch from legacy hash without change of count is marked with equal counts
+func (d *clusterStorage) checkCutover(ctx context.Context) (bool, error) {
+	var completed bool
+	_, err := d.markers().QueryOneContext(ctx, pg.Scan(&completed), `
+		select exists(select 1 from resharding where from_count = ? and to_count = ?);
+	`, d.router.from, d.router.to)
+	if err != nil {
+		return false, fmt.Errorf("failed check cutover marker: %v", err)
+	}
+	if completed {
+		d.router.cutover.Store(true)
+	}
+	return completed, nil
+}
+
+// RunResharding moves keys to their new shards and then marks cutover. Only one instance moves keys,
+// the others wait for cutover marker and read both old and new shards till then
+func (d *clusterStorage) RunResharding(ctx context.Context) {
+	if !d.router.resharding() {
+		return
+	}
+	logger.InfoKV(ctx, "resharding started", "from", d.router.from, "to", d.router.to)
+
+	ticker := time.NewTicker(reshardInterval)
+	defer ticker.Stop()
+
+	for {
+		completed, err := d.reshard(ctx)
+		if err != nil {
+			logger.ErrorKV(ctx, "failed move keys to new shards", "error", err)
+		}
+		if completed {
+			logger.InfoKV(ctx, "resharding completed, set PG_SHARDS_COUNT to new count and reset PG_RESHARD_TO and PG_RESHARD_FROM_LEGACY_HASH",
+				"from", d.router.from, "to", d.router.to, "moved", d.rowsMoved.Load())
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *clusterStorage) reshard(ctx context.Context) (bool, error) {
+	completed, err := d.checkCutover(ctx)
+	if err != nil || completed {
+		return completed, err
+	}
+
+	// session lock is bound to connection, so one connection is kept till the end
+	conn := d.markers().Conn()
+	defer func() { _ = conn.Close() }()
+
+	var locked bool
+	_, err = conn.QueryOneContext(ctx, pg.Scan(&locked), `select pg_try_advisory_lock(?);`, reshardLockID)
+	if err != nil {
+		return false, fmt.Errorf("failed lock resharding: %v", err)
+	}
+	if !locked {
+		return false, nil
+	}
+	defer func() {
+		_, _ = conn.ExecContext(context.Background(), `select pg_advisory_unlock(?);`, reshardLockID)
+	}()
+
+	// previous mover could finish while lock was awaited
+	completed, err = d.checkCutover(ctx)
+	if err != nil || completed {
+		return completed, err
+	}
+
+	ctx, span := d.tracer.Start(ctx, "reshard")
+	defer span.End()
+
+	d.shardsDone.Store(0)
+	for shardID := range d.cluster.Shards(nil) {
+		err = d.reshardShard(ctx, int64(shardID))
+		if err != nil {
+			return false, fmt.Errorf("failed move keys of shard %d: %v", shardID, err)
+		}
+		d.shardsDone.Add(1)
+	}
+
+	_, err = d.markers().ExecContext(ctx, `
+		insert into resharding (from_count, to_count, completed_at) values (?, ?, now())
+		on conflict do nothing;
+	`, d.router.from, d.router.to)
+	if err != nil {
+		return false, fmt.Errorf("failed set cutover marker: %v", err)
+	}
+	d.router.cutover.Store(true)
+
+	return true, nil
+}
+
+func (d *clusterStorage) reshardShard(ctx context.Context, shardID int64) error {
+	shard := d.cluster.Shard(shardID)
+
+	var tables []string
+	_, err := shard.QueryContext(ctx, &tables, `
+		select table_name from information_schema.columns
+		where column_name = 'uid' and table_schema = 'shard' || ?SHARD_ID and table_name <> all(?);
+	`, pg.Array(internalTables))
+	if err != nil {
+		return fmt.Errorf("failed get tables: %v", err)
+	}
+
+	for _, table := range tables {
+		var last string
+		for {
+			var keys []string
+			_, err = shard.QueryContext(ctx, &keys, strings.ReplaceAll(`
+				select uid from ?SHARD.table where uid collate "C" > ? order by uid collate "C" limit ?;
+			`, "table", table), last, reshardBatch)
+			if err != nil {
+				return fmt.Errorf("failed select keys of '%s': %v", table, err)
+			}
+
+			for _, key := range keys {
+				// only keys written before resharding may be in wrong shard
+				target := d.router.shard(key)
+				if target == shardID {
+					continue
+				}
+				err = d.moveKey(ctx, key, table, shardID, target)
+				if err != nil {
+					return err
+				}
+				d.rowsMoved.Add(1)
+			}
+
+			if len(keys) < reshardBatch {
+				break
+			}
+			last = keys[len(keys)-1]
+		}
+	}
+
+	return nil
+}
+
+// relocate moves key to its new shard before write, so old record can't shadow or resurrect written one
+func (d *clusterStorage) relocate(ctx context.Context, key string, table string) error {
+	prev, ok := d.router.previous(key)
+	if !ok {
+		return nil
+	}
+	return d.moveKey(ctx, key, table, prev, d.router.shard(key))
+}
+
+// moveKey copies record to target shard and removes it from source one. Source record is locked
+// till it is removed, so concurrent moves and writes of key are serialized. Record which is
+// already in target shard isn't overwritten, it was copied by interrupted move
+func (d *clusterStorage) moveKey(ctx context.Context, key string, table string, from, to int64) error {
+	ctx, span := d.tracer.Start(ctx, "move key to new shard")
+	defer span.End()
+
+	return d.cluster.Shard(from).RunInTransaction(ctx, func(tx *pg.Tx) error {
+		var (
+			data      []byte
+			revision  int64
+			expiresAt pg.NullTime
+		)
+		_, err := tx.QueryOneContext(ctx, pg.Scan(&data, &revision, &expiresAt), strings.ReplaceAll(`
+			select data, revision, expires_at from ?SHARD.table where uid = ? for update;
+		`, "table", table), key)
+		if err == pg.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed lock record '%s': %v", key, err)
+		}
+
+		_, err = d.cluster.Shard(to).ExecContext(ctx, strings.ReplaceAll(`
+			insert into ?SHARD.table (uid, data, revision, expires_at)
+			values (?, ?, ?, ?) on conflict (uid) do nothing;
+		`, "table", table), key, data, revision, expiresAt)
+		if err != nil {
+			return fmt.Errorf("failed copy record '%s': %v", key, err)
+		}
+		// revisions of new shard must exceed moved one, so record created again after removal there
+		// doesn't repeat revisions it had in old shard
+		_, err = d.cluster.Shard(to).ExecContext(ctx, `
+			select setval('?SHARD.storage_events_revision_seq', ?)
+			from ?SHARD.storage_events_revision_seq where last_value < ?;
+		`, revision, revision)
+		if err != nil {
+			return fmt.Errorf("failed advance revisions of shard: %v", err)
+		}
+
+		return remove(ctx, tx, key, table)
+	})
+}
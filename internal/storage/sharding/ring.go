@@ -0,0 +1,89 @@
+package sharding
+
+import (
+	"hash/fnv"
+	"io"
+	"sync/atomic"
+)
+
+// jumpHash is jump consistent hash of Lamping and Veach, change of buckets count from n to m
+// moves only |n-m|/max(n, m) of keys, they go to added buckets or leave removed ones
+func jumpHash(key string, buckets int) int64 {
+	hf := fnv.New64a()
+	_, _ = io.WriteString(hf, key)
+	h := hf.Sum64()
+
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		h = h*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((h>>33)+1)))
+	}
+	return b
+}
+
+// legacyHash is fnv32a modulo shards count, it routed keys before jump hash.
+// Data written by it lands on other shards under jump hash, so it is moved by resharding
+// with PG_RESHARD_FROM_LEGACY_HASH, optionally with PG_RESHARD_TO of new count
+func legacyHash(key string, buckets int) int64 {
+	hf := fnv.New32a()
+	_, _ = io.WriteString(hf, key)
+	return int64(hf.Sum32() % uint32(buckets))
+}
+
+// router maps keys to shards. While resharding is in progress key lives in its new shard
+// or still in its old one, mover relocates keys and cutover makes old shards unused
+type router struct {
+	from int
+	// zero if there is no resharding
+	to int
+	// old shards of keys are found by legacyHash
+	legacy  bool
+	cutover atomic.Bool
+}
+
+func newRouter(from, to int, legacy bool) *router {
+	r := &router{from: from, to: to, legacy: legacy}
+	if legacy && to == 0 {
+		// hash is switched without change of shards count
+		r.to = from
+	}
+	if r.to == 0 || r.to == from && !legacy {
+		r.to = 0
+		r.cutover.Store(true)
+	}
+	return r
+}
+
+// resharding reports whether some keys may still live in their old shards
+func (r *router) resharding() bool {
+	return !r.cutover.Load()
+}
+
+// shard returns shard which key is written to
+func (r *router) shard(key string) int64 {
+	if r.to == 0 {
+		return jumpHash(key, r.from)
+	}
+	return jumpHash(key, r.to)
+}
+
+// previous returns old shard of key which isn't moved yet, ok is false if key doesn't move
+func (r *router) previous(key string) (int64, bool) {
+	if !r.resharding() {
+		return 0, false
+	}
+	prev := jumpHash(key, r.from)
+	if r.legacy {
+		prev = legacyHash(key, r.from)
+	}
+	return prev, prev != jumpHash(key, r.to)
+}
+
+// shardsCount returns count of shards cluster must have, both old and new shards are used while resharding
+func shardsCount(from, to int) int {
+	if to > from {
+		return to
+	}
+	return from
+}
@@ -0,0 +1,162 @@
+package sharding
+
+import (
+	"fmt"
+	"testing"
+)
+
+// routes are golden, data of running clusters is placed by them, so they must never change
+var routes = []struct {
+	key string
+	// shard of 1, 2, 4 and 10 shards
+	jump [4]int64
+	// shard of 4 and 10 shards
+	legacy [2]int64
+}{
+	{key: "", jump: [4]int64{0, 1, 1, 1}, legacy: [2]int64{1, 1}},
+	{key: "a", jump: [4]int64{0, 1, 2, 2}, legacy: [2]int64{0, 0}},
+	{key: "b", jump: [4]int64{0, 0, 3, 3}, legacy: [2]int64{1, 7}},
+	{key: "user:1", jump: [4]int64{0, 0, 0, 5}, legacy: [2]int64{3, 7}},
+	{key: "user:2", jump: [4]int64{0, 0, 2, 7}, legacy: [2]int64{2, 6}},
+	{key: "order-42", jump: [4]int64{0, 0, 0, 7}, legacy: [2]int64{0, 2}},
+	{key: "key-1000", jump: [4]int64{0, 1, 3, 4}, legacy: [2]int64{2, 6}},
+	{key: "zzz", jump: [4]int64{0, 1, 1, 6}, legacy: [2]int64{1, 1}},
+}
+
+func TestJumpHash(t *testing.T) {
+	for _, route := range routes {
+		for i, buckets := range []int{1, 2, 4, 10} {
+			if shard := jumpHash(route.key, buckets); shard != route.jump[i] {
+				t.Fatalf("key '%s' of %d shards goes to %d, want %d", route.key, buckets, shard, route.jump[i])
+			}
+		}
+	}
+
+	t.Run("added shard takes keys only from others", func(t *testing.T) {
+		moved := 0
+		for i := 0; i < 10000; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			before, after := jumpHash(key, 4), jumpHash(key, 5)
+			if before == after {
+				continue
+			}
+			if after != 4 {
+				t.Fatalf("key '%s' moves from %d to old shard %d", key, before, after)
+			}
+			moved++
+		}
+		// a fifth of keys goes to new shard
+		if moved < 1800 || moved > 2200 {
+			t.Fatalf("%d of 10000 keys moved, want about 2000", moved)
+		}
+	})
+}
+
+func TestLegacyHash(t *testing.T) {
+	for _, route := range routes {
+		for i, buckets := range []int{4, 10} {
+			if shard := legacyHash(route.key, buckets); shard != route.legacy[i] {
+				t.Fatalf("key '%s' of %d shards goes to %d, want %d", route.key, buckets, shard, route.legacy[i])
+			}
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	t.Run("without resharding", func(t *testing.T) {
+		for _, r := range []*router{newRouter(4, 0, false), newRouter(4, 4, false)} {
+			if r.resharding() {
+				t.Fatal("router without resharding is resharding")
+			}
+			for _, route := range routes {
+				if shard := r.shard(route.key); shard != route.jump[2] {
+					t.Fatalf("key '%s' goes to %d, want %d", route.key, shard, route.jump[2])
+				}
+				if _, ok := r.previous(route.key); ok {
+					t.Fatalf("key '%s' has previous shard", route.key)
+				}
+			}
+		}
+	})
+
+	t.Run("resharding and cutover", func(t *testing.T) {
+		r := newRouter(4, 10, false)
+		if !r.resharding() {
+			t.Fatal("router isn't resharding")
+		}
+		for _, route := range routes {
+			if shard := r.shard(route.key); shard != route.jump[3] {
+				t.Fatalf("key '%s' goes to %d, want %d", route.key, shard, route.jump[3])
+			}
+			prev, ok := r.previous(route.key)
+			if moves := route.jump[2] != route.jump[3]; ok != moves || ok && prev != route.jump[2] {
+				t.Fatalf("key '%s' has previous shard %d, %v, want %d, %v", route.key, prev, ok, route.jump[2], moves)
+			}
+		}
+
+		r.cutover.Store(true)
+		if r.resharding() {
+			t.Fatal("router is resharding after cutover")
+		}
+		for _, route := range routes {
+			if shard := r.shard(route.key); shard != route.jump[3] {
+				t.Fatalf("key '%s' goes to %d after cutover, want %d", route.key, shard, route.jump[3])
+			}
+			if _, ok := r.previous(route.key); ok {
+				t.Fatalf("key '%s' has previous shard after cutover", route.key)
+			}
+		}
+	})
+
+	t.Run("shrinking", func(t *testing.T) {
+		r := newRouter(10, 4, false)
+		for _, route := range routes {
+			if shard := r.shard(route.key); shard != route.jump[2] {
+				t.Fatalf("key '%s' goes to %d, want %d", route.key, shard, route.jump[2])
+			}
+			prev, ok := r.previous(route.key)
+			if moves := route.jump[2] != route.jump[3]; ok != moves || ok && prev != route.jump[3] {
+				t.Fatalf("key '%s' has previous shard %d, %v, want %d, %v", route.key, prev, ok, route.jump[3], moves)
+			}
+		}
+	})
+
+	t.Run("from legacy hash", func(t *testing.T) {
+		for _, tt := range []struct {
+			name   string
+			to     int
+			target int
+		}{
+			{name: "same count", to: 0, target: 2},
+			{name: "new count", to: 10, target: 3},
+		} {
+			r := newRouter(4, tt.to, true)
+			if !r.resharding() {
+				t.Fatalf("%s: router isn't resharding", tt.name)
+			}
+			for _, route := range routes {
+				if shard := r.shard(route.key); shard != route.jump[tt.target] {
+					t.Fatalf("%s: key '%s' goes to %d, want %d", tt.name, route.key, shard, route.jump[tt.target])
+				}
+				prev, ok := r.previous(route.key)
+				moves := route.legacy[0] != route.jump[tt.target]
+				if ok != moves || ok && prev != route.legacy[0] {
+					t.Fatalf("%s: key '%s' has previous shard %d, %v, want %d, %v",
+						tt.name, route.key, prev, ok, route.legacy[0], moves)
+				}
+			}
+		}
+	})
+}
+
+func TestShardsCount(t *testing.T) {
+	for _, tt := range []struct{ from, to, want int }{
+		{from: 4, to: 0, want: 4},
+		{from: 4, to: 10, want: 10},
+		{from: 10, to: 4, want: 10},
+	} {
+		if got := shardsCount(tt.from, tt.to); got != tt.want {
+			t.Fatalf("shards count of %d to %d is %d, want %d", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
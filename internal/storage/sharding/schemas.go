@@ -0,0 +1,59 @@
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-pg/pg/v10"
+)
+
+func (d *clusterStorage) CheckSchemas(ctx context.Context) error {
+	ctx, span := d.tracer.Start(ctx, "check shard schemas")
+	defer span.End()
+
+	dbs := d.cluster.DBs()
+	for i, db := range dbs {
+		var schemas []string
+		_, err := db.QueryContext(ctx, &schemas, `
+			select nspname from pg_namespace where nspname ~ '^shard[0-9]+$';
+		`)
+		if err != nil {
+			return fmt.Errorf("failed get schemas of server %d: %v", i, err)
+		}
+		existing := make(map[string]struct{}, len(schemas))
+		for _, schema := range schemas {
+			existing[schema] = struct{}{}
+		}
+
+		var missing []string
+		for _, name := range shardNames(d.cluster.Shards(db)) {
+			if _, ok := existing[name]; !ok {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("server %d (%s) has no schemas %s", i, db.Options().Addr, strings.Join(missing, ", "))
+		}
+	}
+
+	return nil
+}
+
+func (d *clusterStorage) ShardSchemas() [][]string {
+	dbs := d.cluster.DBs()
+	schemas := make([][]string, 0, len(dbs))
+	for _, db := range dbs {
+		schemas = append(schemas, shardNames(d.cluster.Shards(db)))
+	}
+	return schemas
+}
+
+// shardNames returns schema names of shards, they are parameters of shard db
+func shardNames(shards []*pg.DB) []string {
+	names := make([]string, 0, len(shards))
+	for _, shard := range shards {
+		names = append(names, string(shard.Formatter().FormatQuery(nil, "?SHARD")))
+	}
+	return names
+}
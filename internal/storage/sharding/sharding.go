@@ -3,100 +3,399 @@ package sharding
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"github.com/go-pg/sharding/v8"
-	"hash/fnv"
-	"io"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/sharding/v8"
 	"github.com/kjushka/microservice-gen/internal/closer"
 	"github.com/kjushka/microservice-gen/internal/config"
 	"github.com/kjushka/microservice-gen/internal/logger"
 	"github.com/kjushka/microservice-gen/internal/storage"
+	"github.com/kjushka/microservice-gen/internal/storage/database"
 	"github.com/kjushka/microservice-gen/internal/storage/serializer"
 	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
 )
 
+const (
+	// listConcurrency limits parallel List queries per physical server
+	listConcurrency = 8
+	// shardsConcurrency limits parallel queries of one GetMany or WriteBatch
+	shardsConcurrency = 16
+)
+
+// ClusterStorage isn't storage.Watcher: shards have independent revision sequences, so their writes
+// don't publish storage events and config refuses STORAGE_WATCH with this backend
 type ClusterStorage interface {
 	storage.Storage
 	GetCluster() *sharding.Cluster
+	// Serializer decodes data returned by GetRaw
+	Serializer() serializer.Serializer
+	// GetRaw returns encoded record, it can be stored in cache as is
+	GetRaw(ctx context.Context, key string, table string) ([]byte, storage.Meta, error)
+	// RecentKeys returns up to limit keys of recently changed records of table, shards don't share
+	// revisions sequence, so order of keys of different shards is approximate
+	RecentKeys(ctx context.Context, table string, limit int) ([]string, error)
+	// WriteBatch applies encoded changes in given order in one transaction per shard,
+	// batch isn't atomic across shards
+	WriteBatch(ctx context.Context, writes []database.Write) error
+	// ReshardingProgress describes moving of keys to new shards count
+	ReshardingProgress() ReshardingProgress
+	// RunResharding moves keys to new shards until all of them are moved or ctx is done
+	RunResharding(ctx context.Context)
+	// ShardSchemas returns schema names of shards of every server in order of servers
+	ShardSchemas() [][]string
+	// CheckSchemas returns error if some of servers lack schemas of their shards
+	CheckSchemas(ctx context.Context) error
+	// RunSweeper removes expired records until ctx is done
+	RunSweeper(ctx context.Context)
+	// RunReencrypt encrypts records by current key once per key id and drops their cached values
+	RunReencrypt(ctx context.Context, invalidator storage.Invalidator)
 }
 
 func InitDB(ctx context.Context, cfg *config.Config, tracer trace.Tracer) (ClusterStorage, error) {
-	db := pg.Connect(&pg.Options{
-		User:     cfg.DBUser,
-		Password: cfg.DBPass,
-		Addr:     fmt.Sprintf("%s:%s", cfg.DBHost, cfg.DBPort),
-	})
-
-	err := db.Ping(ctx)
+	s, err := serializer.Init(cfg)
 	if err != nil {
-		for err != nil {
-			time.Sleep(time.Second * 2)
-			logger.InfoKV(ctx, "sleeping for wait db")
-			err = db.Ping(ctx)
+		return nil, fmt.Errorf("failed create serializer: %v", err)
+	}
+
+	// shard i lives on server i % len(servers), so shards don't change servers on resharding
+	for _, count := range []int{cfg.DBShardsCount, cfg.DBReshardTo} {
+		if len(cfg.DBShardServers) == 0 || count%len(cfg.DBShardServers) != 0 {
+			return nil, fmt.Errorf(
+				"shards count %d must be multiple of servers count %d",
+				count, len(cfg.DBShardServers),
+			)
 		}
 	}
 
-	dbs := []*pg.DB{db} // list of physical PostgreSQL servers
-	cluster := sharding.NewCluster(dbs, cfg.DBShardsCount)
-	closer.Add(cluster.Close)
+	dbs := make([]*pg.DB, 0, len(cfg.DBShardServers)) // list of physical PostgreSQL servers
+	for _, server := range cfg.DBShardServers {
+		db := pg.Connect(&pg.Options{
+			User:     server.User,
+			Password: server.Password,
+			Database: server.Database,
+			Addr:     fmt.Sprintf("%s:%s", server.Host, server.Port),
+			PoolSize: server.PoolSize,
+		})
 
-	shardByKeyFn := func(shardsCount int) func(key string) int64 {
-		return func(key string) int64 {
-			hf := fnv.New32a()
-			_, _ = io.WriteString(hf, key)
-			return int64(hf.Sum32() % uint32(shardsCount))
+		err = db.Ping(ctx)
+		if err != nil {
+			for err != nil {
+				time.Sleep(time.Second * 2)
+				logger.InfoKV(ctx, "sleeping for wait db", "host", server.Host)
+				err = db.Ping(ctx)
+			}
 		}
-	}(cfg.DBShardsCount)
+		dbs = append(dbs, db)
+	}
 
-	return &clusterStorage{
-		cluster,
-		shardByKeyFn,
-		serializer.NewMessagePackSerializer(),
-		tracer,
-	}, nil
+	cluster := sharding.NewCluster(dbs, shardsCount(cfg.DBShardsCount, cfg.DBReshardTo))
+	closer.Add(cluster.Close)
+
+	d := &clusterStorage{
+		cluster:       cluster,
+		router:        newRouter(cfg.DBShardsCount, cfg.DBReshardTo, cfg.DBReshardFromLegacyHash),
+		sweepInterval: cfg.DBSweepInterval,
+		serializer:    s,
+		tracer:        tracer,
+	}
+	err = d.initResharding(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
 }
 
 type clusterStorage struct {
-	cluster    *sharding.Cluster
-	shardByKey func(key string) int64
-	serializer *serializer.MessagePackSerializer
-	tracer     trace.Tracer
+	cluster       *sharding.Cluster
+	router        *router
+	sweepInterval time.Duration
+	serializer    serializer.Serializer
+	tracer        trace.Tracer
+
+	// resharding progress of this instance
+	shardsDone atomic.Int64
+	rowsMoved  atomic.Int64
 }
 
 func (d *clusterStorage) GetCluster() *sharding.Cluster {
 	return d.cluster
 }
 
+func (d *clusterStorage) Serializer() serializer.Serializer {
+	return d.serializer
+}
+
 func (d *clusterStorage) Get(ctx context.Context, key string, table string, dest any) error {
-	ctx, span := d.tracer.Start(ctx, "get from cache")
+	_, err := d.GetWithMeta(ctx, key, table, dest)
+	return err
+}
+
+func (d *clusterStorage) GetWithMeta(ctx context.Context, key string, table string, dest any) (storage.Meta, error) {
+	data, meta, err := d.GetRaw(ctx, key, table)
+	if err != nil {
+		return storage.Meta{}, err
+	}
+
+	err = d.serializer.Decode(bytes.NewReader(data), dest)
+	if err != nil {
+		return storage.Meta{}, fmt.Errorf("failed decode data: %v", err)
+	}
+
+	return meta, nil
+}
+
+// GetRaw reads old shard of key first while resharding, so key which is moved meanwhile isn't missed
+func (d *clusterStorage) GetRaw(ctx context.Context, key string, table string) ([]byte, storage.Meta, error) {
+	ctx, span := d.tracer.Start(ctx, "get from db")
 	defer span.End()
 
-	var data []byte
-	_, err := d.cluster.Shard(d.shardByKey(key)).QueryOneContext(ctx, pg.Scan(data), strings.ReplaceAll(`
-		select data from ?SHARD.table where uid = $1;
+	if prev, ok := d.router.previous(key); ok {
+		data, meta, err := d.getRaw(ctx, d.cluster.Shard(prev), key, table)
+		if !errors.Is(err, storage.ErrNotFound) {
+			return data, meta, err
+		}
+	}
+
+	return d.getRaw(ctx, d.cluster.Shard(d.router.shard(key)), key, table)
+}
+
+func (d *clusterStorage) getRaw(ctx context.Context, shard *pg.DB, key string, table string) ([]byte, storage.Meta, error) {
+	var (
+		data      []byte
+		revision  int64
+		expiresAt time.Time
+	)
+	_, err := shard.QueryOneContext(ctx, pg.Scan(&data, &revision, &expiresAt), strings.ReplaceAll(`
+		select data, revision, expires_at from ?SHARD.table
+		where uid = ? and (expires_at is null or expires_at > now());
 	`, "table", table), key)
+	if err == pg.ErrNoRows {
+		return nil, storage.Meta{}, storage.ErrNotFound
+	}
 	if err != nil {
-		return fmt.Errorf("failed get from db: %s", err)
+		return nil, storage.Meta{}, fmt.Errorf("failed get from db: %s", err)
 	}
 
-	err = d.serializer.Decode(bytes.NewReader(data), dest)
+	return data, storage.Meta{Revision: revision, ExpiresAt: expiresAt}, nil
+}
+
+// GetMany queries shards of keys in parallel, one query per shard
+func (d *clusterStorage) GetMany(ctx context.Context, keys []string, table string, dest ...any) error {
+	ctx, span := d.tracer.Start(ctx, "get many from db")
+	defer span.End()
+
+	if len(keys) != len(dest) {
+		return errors.New("len of keys not equal len of dest")
+	}
+
+	found := make(map[string][]byte, len(keys))
+	// while resharding keys which aren't moved yet are read from old shards first
+	byShard := make(map[int64][]string)
+	for _, key := range keys {
+		if prev, ok := d.router.previous(key); ok {
+			byShard[prev] = append(byShard[prev], key)
+		}
+	}
+	err := d.fetch(ctx, table, byShard, found)
+	if err != nil {
+		return err
+	}
+
+	byShard = make(map[int64][]string)
+	for _, key := range keys {
+		if _, ok := found[key]; ok {
+			continue
+		}
+		shardID := d.router.shard(key)
+		byShard[shardID] = append(byShard[shardID], key)
+	}
+	err = d.fetch(ctx, table, byShard, found)
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for i, key := range keys {
+		data, ok := found[key]
+		if !ok {
+			missing = append(missing, key)
+			continue
+		}
+		err = d.serializer.Decode(bytes.NewReader(data), dest[i])
+		if err != nil {
+			return fmt.Errorf("failed decode data: %v", err)
+		}
+	}
+	if len(missing) > 0 {
+		return &storage.MissingKeysError{Table: table, Keys: missing}
+	}
+
+	return nil
+}
+
+// fetch adds encoded records of keys to found, one query per shard
+func (d *clusterStorage) fetch(ctx context.Context, table string, byShard map[int64][]string, found map[string][]byte) error {
+	var mu sync.Mutex
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(shardsConcurrency)
+	for shardID, shardKeys := range byShard {
+		shard, shardKeys := d.cluster.Shard(shardID), shardKeys
+		g.Go(func() error {
+			var rows []struct {
+				UID  string
+				Data []byte
+			}
+			_, err := shard.QueryContext(gCtx, &rows, strings.ReplaceAll(`
+				select uid, data from ?SHARD.table
+				where uid in (?) and (expires_at is null or expires_at > now());
+			`, "table", table), pg.In(shardKeys))
+			if err != nil {
+				return err
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, row := range rows {
+				found[row.UID] = row.Data
+			}
+			return nil
+		})
+	}
+	err := g.Wait()
 	if err != nil {
-		return fmt.Errorf("failed decode data: %v", err)
+		return fmt.Errorf("failed get from db: %v", err)
 	}
 
 	return nil
 }
 
-func (d *clusterStorage) GetMany(ctx context.Context, keys []string, table string, dest ...any) error {
-	panic("not implemented")
+func (d *clusterStorage) RecentKeys(ctx context.Context, table string, limit int) ([]string, error) {
+	ctx, span := d.tracer.Start(ctx, "get recent keys from db")
+	defer span.End()
+
+	type recent struct {
+		UID      string
+		Revision int64
+	}
+	var (
+		mu   sync.Mutex
+		rows []recent
+	)
+	err := d.cluster.ForEachNShards(listConcurrency, func(shard *pg.DB) error {
+		var shardRows []recent
+		_, err := shard.QueryContext(ctx, &shardRows, strings.ReplaceAll(`
+			select uid, revision from ?SHARD.table
+			where expires_at is null or expires_at > now()
+			order by revision desc
+			limit ?;
+		`, "table", table), limit)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		rows = append(rows, shardRows...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed get recent keys from db: %v", err)
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].Revision > rows[j].Revision
+	})
+	// interrupted move of resharding leaves key in both shards
+	seen := make(map[string]struct{}, len(rows))
+	keys := make([]string, 0, limit)
+	for _, row := range rows {
+		if _, ok := seen[row.UID]; ok {
+			continue
+		}
+		seen[row.UID] = struct{}{}
+		keys = append(keys, row.UID)
+		if len(keys) == limit {
+			break
+		}
+	}
+
+	return keys, nil
 }
 
-func (d *clusterStorage) Save(ctx context.Context, key string, data any, table string) error {
-	ctx, span := d.tracer.Start(ctx, "save to cache")
+// List merges pages of all shards, keys are compared bytewise both in go and in postgres
+func (d *clusterStorage) List(ctx context.Context, table string, prefix string, pageToken string, limit int) ([]storage.Item, string, error) {
+	ctx, span := d.tracer.Start(ctx, "list from db")
+	defer span.End()
+
+	if limit <= 0 {
+		return nil, "", storage.ErrInvalidLimit
+	}
+	lastKey, err := storage.DecodePageToken(pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var (
+		mu    sync.Mutex
+		items []storage.Item
+	)
+	err = d.cluster.ForEachNShards(listConcurrency, func(shard *pg.DB) error {
+		var rows []struct {
+			UID      string
+			Data     []byte
+			Revision int64
+		}
+		// one extra row shows that there is next page
+		_, err := shard.QueryContext(ctx, &rows, strings.ReplaceAll(`
+			select uid, data, revision from ?SHARD.table
+			where starts_with(uid, ?) and uid collate "C" > ? and (expires_at is null or expires_at > now())
+			order by uid collate "C"
+			limit ?;
+		`, "table", table), prefix, lastKey, limit+1)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, row := range rows {
+			items = append(items, storage.NewItem(row.UID, row.Revision, row.Data, d.serializer.Decode))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed list from db: %v", err)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Key < items[j].Key
+	})
+	// interrupted move of resharding leaves key in both shards
+	unique := items[:0]
+	for _, item := range items {
+		if len(unique) == 0 || item.Key != unique[len(unique)-1].Key {
+			unique = append(unique, item)
+		}
+	}
+	items = unique
+	if len(items) <= limit {
+		return items, "", nil
+	}
+	items = items[:limit]
+	return items, storage.EncodePageToken(items[limit-1].Key), nil
+}
+
+func (d *clusterStorage) Save(ctx context.Context, key string, data any, table string, opts ...storage.SaveOption) error {
+	ctx, span := d.tracer.Start(ctx, "save to db")
 	defer span.End()
 
 	buf := bytes.NewBuffer(nil)
@@ -105,12 +404,27 @@ func (d *clusterStorage) Save(ctx context.Context, key string, data any, table s
 		return fmt.Errorf("failed encode data: %v", err)
 	}
 
-	_, err = d.cluster.Shard(d.shardByKey(key)).ExecContext(ctx, strings.ReplaceAll(`
-		insert into ?SHARD.table (uid, data)
-		values ($1, $2) on conflict (uid) do
+	err = d.relocate(ctx, key, table)
+	if err != nil {
+		return err
+	}
+
+	return upsert(ctx, d.cluster.Shard(d.router.shard(key)), key, table, buf.Bytes(), opts...)
+}
+
+// nextRevision is taken from events sequence of shard like revisions of database.
+// Revision of record never decreases, records written before revisions came from sequence
+// could have revisions above it
+const nextRevision = `nextval('?SHARD.storage_events_revision_seq')`
+
+// upsert saves encoded record to shard db or to transaction of shard
+func upsert(ctx context.Context, db pg.DBI, key string, table string, data []byte, opts ...storage.SaveOption) error {
+	_, err := db.ExecContext(ctx, strings.ReplaceAll(`
+		insert into ?SHARD.table as t (uid, data, revision, expires_at)
+		values (?, ?, `+nextRevision+`, coalesce(?::timestamptz, now() + ? * interval '1 millisecond')) on conflict (uid) do
 		update
-		set data = excluded.data;
-	`, "table", table), key)
+		set data = excluded.data, revision = greatest(excluded.revision, t.revision + 1), expires_at = excluded.expires_at;
+	`, "table", table), key, data, expiresAt(opts), ttlMillis(opts))
 	if err != nil {
 		return fmt.Errorf("failed upsert data: %v", err)
 	}
@@ -118,14 +432,155 @@ func (d *clusterStorage) Save(ctx context.Context, key string, data any, table s
 	return nil
 }
 
+// SaveIf takes revision from sequence of shard, so record created again after removal doesn't repeat
+// revisions of removed one
+func (d *clusterStorage) SaveIf(
+	ctx context.Context,
+	key string,
+	table string,
+	data any,
+	expectedRevision int64,
+	opts ...storage.SaveOption,
+) (int64, error) {
+	ctx, span := d.tracer.Start(ctx, "conditional save to db")
+	defer span.End()
+
+	buf := bytes.NewBuffer(nil)
+	err := d.serializer.Encode(buf, data)
+	if err != nil {
+		return 0, fmt.Errorf("failed encode data: %v", err)
+	}
+
+	err = d.relocate(ctx, key, table)
+	if err != nil {
+		return 0, err
+	}
+	shard := d.cluster.Shard(d.router.shard(key))
+
+	var (
+		revision int64
+		res      pg.Result
+	)
+	// expired record is treated as missing one
+	if expectedRevision == 0 {
+		res, err = shard.QueryContext(ctx, pg.Scan(&revision), strings.ReplaceAll(`
+			insert into ?SHARD.table as t (uid, data, revision, expires_at)
+			values (?, ?, `+nextRevision+`, coalesce(?::timestamptz, now() + ? * interval '1 millisecond')) on conflict (uid) do
+			update
+			set data = excluded.data, revision = greatest(excluded.revision, t.revision + 1), expires_at = excluded.expires_at
+			where t.expires_at <= now()
+			returning revision;
+		`, "table", table), key, buf.Bytes(), expiresAt(opts), ttlMillis(opts))
+	} else {
+		res, err = shard.QueryContext(ctx, pg.Scan(&revision), strings.ReplaceAll(`
+			update ?SHARD.table
+			set data = ?, revision = greatest(`+nextRevision+`, revision + 1),
+				expires_at = coalesce(?::timestamptz, now() + ? * interval '1 millisecond')
+			where uid = ? and revision = ? and (expires_at is null or expires_at > now())
+			returning revision;
+		`, "table", table), buf.Bytes(), expiresAt(opts), ttlMillis(opts), key, expectedRevision)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed save data: %v", err)
+	}
+
+	if res.RowsReturned() == 0 {
+		var actual int64
+		_, err = shard.QueryOneContext(ctx, pg.Scan(&actual), strings.ReplaceAll(`
+			select revision from ?SHARD.table
+			where uid = ? and (expires_at is null or expires_at > now());
+		`, "table", table), key)
+		if err != nil && err != pg.ErrNoRows {
+			return 0, fmt.Errorf("failed get actual revision: %v", err)
+		}
+		return 0, &storage.ConflictError{
+			Table:            table,
+			Key:              key,
+			ExpectedRevision: expectedRevision,
+			ActualRevision:   actual,
+		}
+	}
+
+	return revision, nil
+}
+
 func (d *clusterStorage) Delete(ctx context.Context, key string, table string) error {
-	ctx, span := d.tracer.Start(ctx, "save to cache")
+	ctx, span := d.tracer.Start(ctx, "delete in db")
 	defer span.End()
 
-	_, err := d.cluster.Shard(d.shardByKey(key)).ExecContext(ctx, strings.ReplaceAll(`delete from ?SHADR.table where uid = $1;`, "table", table), key)
+	err := d.relocate(ctx, key, table)
+	if err != nil {
+		return err
+	}
+
+	return remove(ctx, d.cluster.Shard(d.router.shard(key)), key, table)
+}
+
+func remove(ctx context.Context, db pg.DBI, key string, table string) error {
+	_, err := db.ExecContext(ctx, strings.ReplaceAll(`delete from ?SHARD.table where uid = ?;`, "table", table), key)
 	if err != nil {
 		return fmt.Errorf("failed remove data from db: %v", err)
 	}
 
 	return nil
 }
+
+func (d *clusterStorage) WriteBatch(ctx context.Context, writes []database.Write) error {
+	ctx, span := d.tracer.Start(ctx, "write batch to db")
+	defer span.End()
+
+	// order of writes of one key is kept, they belong to one shard
+	byShard := make(map[int64][]database.Write)
+	for _, w := range writes {
+		err := d.relocate(ctx, w.Key, w.Table)
+		if err != nil {
+			return err
+		}
+		shardID := d.router.shard(w.Key)
+		byShard[shardID] = append(byShard[shardID], w)
+	}
+
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(shardsConcurrency)
+	for shardID, shardWrites := range byShard {
+		shard, shardWrites := d.cluster.Shard(shardID), shardWrites
+		g.Go(func() error {
+			return shard.RunInTransaction(gCtx, func(tx *pg.Tx) error {
+				for _, w := range shardWrites {
+					var err error
+					if w.Delete {
+						err = remove(gCtx, tx, w.Key, w.Table)
+					} else {
+						err = upsert(gCtx, tx, w.Key, w.Table, w.Data, storage.WithExpiresAt(w.ExpiresAt))
+					}
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		})
+	}
+
+	return g.Wait()
+}
+
+// ttlMillis returns nil for records without ttl or with moment of expiry, so expires_at becomes null
+// or expiresAt
+func ttlMillis(opts []storage.SaveOption) *int64 {
+	o := storage.NewSaveOptions(opts...)
+	if o.TTL <= 0 || !o.ExpiresAt.IsZero() {
+		return nil
+	}
+	ms := o.TTL.Milliseconds()
+	return &ms
+}
+
+// expiresAt returns nil for records without moment of expiry, ttl is used for them
+func expiresAt(opts []storage.SaveOption) *time.Time {
+	o := storage.NewSaveOptions(opts...)
+	if o.ExpiresAt.IsZero() {
+		return nil
+	}
+	return &o.ExpiresAt
+}
@@ -0,0 +1,265 @@
+//go:build integration
+
+package sharding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/kjushka/microservice-gen/internal/config"
+	"github.com/kjushka/microservice-gen/internal/migrator"
+	"github.com/kjushka/microservice-gen/internal/storage"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tests run against one server from PG_HOST, PG_PORT, PG_DATABASE, PG_USER and PG_PASS,
+// its shard schemas are migrated before tests
+const (
+	testShardsCount = 4
+	testTable       = "items"
+)
+
+func newTestStorage(t *testing.T) *clusterStorage {
+	t.Helper()
+	ctx := context.Background()
+
+	server := config.DBServer{
+		Host:     testEnv(t, "PG_HOST"),
+		Port:     testEnv(t, "PG_PORT"),
+		Database: testEnv(t, "PG_DATABASE"),
+		User:     testEnv(t, "PG_USER"),
+		Password: testEnv(t, "PG_PASS"),
+	}
+	cfg := &config.Config{
+		DBShardsCount:        testShardsCount,
+		DBShardServers:       []config.DBServer{server},
+		DBMigrateLockTimeout: time.Minute,
+		StorageSerializer:    "json",
+		StorageCompression:   "none",
+	}
+
+	db, err := InitDB(ctx, cfg, trace.NewNoopTracerProvider().Tracer("test"))
+	if err != nil {
+		t.Fatalf("init sharded storage: %v", err)
+	}
+	_, err = migrator.InitMigrator(cfg).MigrateShards(ctx, cfg.DBShardServers, db.ShardSchemas())
+	if err != nil {
+		t.Fatalf("migrate shards: %v", err)
+	}
+	return db.(*clusterStorage)
+}
+
+func testEnv(t *testing.T, name string) string {
+	t.Helper()
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		t.Skipf("%s isn't set", name)
+	}
+	return value
+}
+
+// testKeys returns keys unique for test run, they are removed after test
+func testKeys(t *testing.T, d *clusterStorage, count int) []string {
+	t.Helper()
+	prefix := fmt.Sprintf("%s-%d-", strings.ReplaceAll(t.Name(), "/", "-"), time.Now().UnixNano())
+	keys := make([]string, count)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%s%02d", prefix, i)
+	}
+	t.Cleanup(func() {
+		for _, key := range keys {
+			_ = d.Delete(context.Background(), key, testTable)
+		}
+	})
+	return keys
+}
+
+// shardsOf returns shards physically holding key
+func shardsOf(t *testing.T, d *clusterStorage, key string) []int64 {
+	t.Helper()
+	var shards []int64
+	for id := int64(0); id < testShardsCount; id++ {
+		var count int
+		_, err := d.cluster.Shard(id).QueryOneContext(context.Background(), pg.Scan(&count),
+			`select count(*) from ?SHARD.`+testTable+` where uid = ?;`, key)
+		if err != nil {
+			t.Fatalf("count key in shard %d: %v", id, err)
+		}
+		if count > 0 {
+			shards = append(shards, id)
+		}
+	}
+	return shards
+}
+
+func TestRouting(t *testing.T) {
+	d := newTestStorage(t)
+	ctx := context.Background()
+
+	for _, key := range testKeys(t, d, 16) {
+		err := d.Save(ctx, key, key, testTable)
+		if err != nil {
+			t.Fatalf("save '%s': %v", key, err)
+		}
+		shards := shardsOf(t, d, key)
+		if len(shards) != 1 || shards[0] != d.router.shard(key) {
+			t.Fatalf("key '%s' is stored in shards %v, want only %d", key, shards, d.router.shard(key))
+		}
+
+		var value string
+		err = d.Get(ctx, key, testTable, &value)
+		if err != nil || value != key {
+			t.Fatalf("get '%s': value '%s', error %v", key, value, err)
+		}
+	}
+}
+
+func TestGetManyAcrossShards(t *testing.T) {
+	d := newTestStorage(t)
+	ctx := context.Background()
+
+	keys := testKeys(t, d, 12)
+	saved, missing := keys[:len(keys)-1], keys[len(keys)-1]
+	shards := make(map[int64]struct{})
+	for _, key := range saved {
+		err := d.Save(ctx, key, key, testTable)
+		if err != nil {
+			t.Fatalf("save '%s': %v", key, err)
+		}
+		shards[d.router.shard(key)] = struct{}{}
+	}
+	if len(shards) < 2 {
+		t.Fatalf("keys fall into %d shard, test needs several", len(shards))
+	}
+
+	// missing key goes first, so it can't shift values of the others
+	requested := append([]string{missing}, saved...)
+	values := make([]string, len(requested))
+	dest := make([]any, len(requested))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	err := d.GetMany(ctx, requested, testTable, dest...)
+	var missingErr *storage.MissingKeysError
+	if !errors.As(err, &missingErr) || len(missingErr.Keys) != 1 || missingErr.Keys[0] != missing {
+		t.Fatalf("get many error is %v, want missing '%s'", err, missing)
+	}
+	for i, key := range requested[1:] {
+		if values[i+1] != key {
+			t.Fatalf("value of '%s' is '%s'", key, values[i+1])
+		}
+	}
+}
+
+func TestListPaging(t *testing.T) {
+	d := newTestStorage(t)
+	ctx := context.Background()
+
+	keys := testKeys(t, d, 7)
+	for _, key := range keys {
+		err := d.Save(ctx, key, key, testTable)
+		if err != nil {
+			t.Fatalf("save '%s': %v", key, err)
+		}
+	}
+	prefix := strings.TrimSuffix(keys[0], "00")
+
+	var (
+		listed []string
+		pages  int
+		token  string
+	)
+	for {
+		items, next, err := d.List(ctx, testTable, prefix, token, 3)
+		if err != nil {
+			t.Fatalf("list page %d: %v", pages, err)
+		}
+		pages++
+		for _, item := range items {
+			var value string
+			err = item.Decode(&value)
+			if err != nil || value != item.Key {
+				t.Fatalf("item '%s': value '%s', error %v", item.Key, value, err)
+			}
+			listed = append(listed, item.Key)
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+
+	if pages != 3 {
+		t.Fatalf("listed %d pages, want 3", pages)
+	}
+	if strings.Join(listed, ",") != strings.Join(keys, ",") {
+		t.Fatalf("listed keys %v, want %v", listed, keys)
+	}
+}
+
+func TestListInvalidLimit(t *testing.T) {
+	d := newTestStorage(t)
+
+	for _, limit := range []int{0, -1} {
+		_, _, err := d.List(context.Background(), testTable, "", "", limit)
+		if !errors.Is(err, storage.ErrInvalidLimit) {
+			t.Fatalf("list with limit %d: error %v, want invalid limit", limit, err)
+		}
+	}
+}
+
+// watch is refused by config for sharded backend, storage mustn't offer it half-working
+func TestWatchIsNotOffered(t *testing.T) {
+	d := newTestStorage(t)
+	if _, ok := any(d).(storage.Watcher); ok {
+		t.Fatal("sharded storage implements watcher, but shard writes don't publish events")
+	}
+
+	cfg := &config.Config{StorageBackend: "sharded", StorageWatch: true}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("config with watch of sharded backend is accepted")
+	}
+}
+
+func TestSaveIf(t *testing.T) {
+	d := newTestStorage(t)
+	ctx := context.Background()
+	key := testKeys(t, d, 1)[0]
+
+	revision, err := d.SaveIf(ctx, key, testTable, "1", 0)
+	if err != nil {
+		t.Fatalf("create '%s': %v", key, err)
+	}
+	_, err = d.SaveIf(ctx, key, testTable, "2", 0)
+	var conflict *storage.ConflictError
+	if !errors.As(err, &conflict) || conflict.ActualRevision != revision {
+		t.Fatalf("create of existing key: error %v, want conflict with revision %d", err, revision)
+	}
+	_, err = d.SaveIf(ctx, key, testTable, "2", revision+1)
+	if !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("save with wrong revision: error %v, want conflict", err)
+	}
+
+	next, err := d.SaveIf(ctx, key, testTable, "2", revision)
+	if err != nil {
+		t.Fatalf("save with actual revision: %v", err)
+	}
+	if next <= revision {
+		t.Fatalf("revision %d isn't greater than previous %d", next, revision)
+	}
+
+	var value string
+	meta, err := d.GetWithMeta(ctx, key, testTable, &value)
+	if err != nil || value != "2" || meta.Revision != next {
+		t.Fatalf("get '%s': value '%s', revision %d, error %v", key, value, meta.Revision, err)
+	}
+	if shards := shardsOf(t, d, key); len(shards) != 1 || shards[0] != d.router.shard(key) {
+		t.Fatalf("key '%s' is stored in shards %v, want only %d", key, shards, d.router.shard(key))
+	}
+}
@@ -0,0 +1,65 @@
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/kjushka/microservice-gen/internal/logger"
+)
+
+const sweepBatch = 1000
+
+func (d *clusterStorage) RunSweeper(ctx context.Context) {
+	ticker := time.NewTicker(d.sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := d.cluster.ForEachShard(func(shard *pg.DB) error {
+			return d.sweepShard(ctx, shard)
+		})
+		if err != nil {
+			logger.ErrorKV(ctx, "failed sweep expired records", "error", err)
+		}
+	}
+}
+
+func (d *clusterStorage) sweepShard(ctx context.Context, shard *pg.DB) error {
+	ctx, span := d.tracer.Start(ctx, "sweep shard")
+	defer span.End()
+
+	// every table with expires_at column is sweepable
+	var tables []string
+	_, err := shard.QueryContext(ctx, &tables, `
+		select table_name from information_schema.columns
+		where column_name = 'expires_at' and table_schema = 'shard' || ?SHARD_ID;
+	`)
+	if err != nil {
+		return fmt.Errorf("failed get tables: %v", err)
+	}
+
+	for _, table := range tables {
+		for {
+			res, err := shard.ExecContext(ctx, strings.ReplaceAll(`
+				delete from ?SHARD.table
+				where uid in (select uid from ?SHARD.table where expires_at <= now() limit ?);
+			`, "table", table), sweepBatch)
+			if err != nil {
+				return fmt.Errorf("failed sweep '%s': %v", table, err)
+			}
+			if res.RowsAffected() < sweepBatch {
+				break
+			}
+		}
+	}
+
+	return nil
+}
@@ -1,103 +1,354 @@
 package storage_with_cache
 
 import (
+	"bytes"
 	"context"
-	"github.com/kjushka/microservice-gen/internal/errgroup"
+	"errors"
+	"fmt"
+	"github.com/kjushka/microservice-gen/internal/closer"
+	"github.com/kjushka/microservice-gen/internal/logger"
 	"github.com/kjushka/microservice-gen/internal/storage"
 	"github.com/kjushka/microservice-gen/internal/storage/cache"
 	"github.com/kjushka/microservice-gen/internal/storage/database"
-	"github.com/redis/go-redis/v9"
+	"github.com/kjushka/microservice-gen/internal/storage/serializer"
 	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+	"sync"
+	"time"
 )
 
-func NewStorage(cache cache.Cache, db database.DBStorage, tracer trace.Tracer) storage.Storage {
-	return &storageWithCache{
-		cache:  cache,
-		db:     db,
-		tracer: tracer,
+// Backend is source of truth behind cache, it is implemented by
+// database.DBStorage and sharding.ClusterStorage
+type Backend interface {
+	storage.Storage
+	// Serializer decodes data returned by GetRaw
+	Serializer() serializer.Serializer
+	// GetRaw returns encoded record, it can be stored in cache as is
+	GetRaw(ctx context.Context, key string, table string) ([]byte, storage.Meta, error)
+	// RecentKeys returns up to limit keys of table worth warming up
+	RecentKeys(ctx context.Context, table string, limit int) ([]string, error)
+	// WriteBatch applies encoded changes in given order
+	WriteBatch(ctx context.Context, writes []database.Write) error
+}
+
+// Storage drops cached records on demand in addition to storage.Storage
+type Storage interface {
+	storage.Storage
+	storage.Invalidator
+}
+
+func NewStorage(cache cache.Cache, db Backend, tracer trace.Tracer, opts ...Option) Storage {
+	s := &storageWithCache{
+		cache:       cache,
+		db:          db,
+		loadTimeout: defaultLoadTimeout,
+		tracer:      tracer,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.writePolicy == WriteBehind {
+		ctx, cancel := context.WithCancel(logger.WithName(context.Background(), "flusher"))
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.runFlusher(ctx)
+		}()
+		closer.Add(func() error {
+			cancel()
+			<-done
+			return nil
+		})
 	}
+
+	return s
 }
 
 type storageWithCache struct {
-	cache  cache.Cache
-	db     database.DBStorage
-	tracer trace.Tracer
+	cache       cache.Cache
+	db          Backend
+	writePolicy WritePolicy
+	loadTimeout time.Duration
+	loads       singleflight.Group
+	refreshing  sync.Map // keys of running revalidations
+	tracer      trace.Tracer
 }
 
+// Get falls through to database on cache miss or failure and populates cache in background.
+// Stale value is returned as is and revalidated in background
 func (s *storageWithCache) Get(ctx context.Context, key string, table string, dest any) error {
 	var err error
 	err = s.cache.Get(ctx, key, table, dest)
-	if err != nil && err != redis.Nil {
-		return err
-	}
-	if err == redis.Nil {
+	switch {
+	case err == nil:
 		return nil
+	case errors.Is(err, cache.ErrStale):
+		s.revalidate(ctx, key, table)
+		return nil
+	case errors.Is(err, cache.ErrNegativeHit):
+		return storage.ErrNotFound
+	case !errors.Is(err, storage.ErrNotFound):
+		logCacheError(ctx, "failed get from cache", key, table, err)
 	}
-	err = s.db.Get(ctx, key, table, dest)
+
+	data, err := s.load(ctx, key, table)
 	if err != nil {
 		return err
 	}
+	err = s.db.Serializer().Decode(bytes.NewReader(data), dest)
+	if err != nil {
+		return fmt.Errorf("failed decode data: %v", err)
+	}
 	return nil
 }
 
+// load collapses concurrent misses of one key into one database query, every caller decodes shared
+// encoded record by itself. Query doesn't depend on ctx of the first caller, so its cancellation doesn't
+// fail the others, every caller stops waiting when its own ctx is done
+func (s *storageWithCache) load(ctx context.Context, key string, table string) ([]byte, error) {
+	loaded := s.loads.DoChan(table+"/"+key, func() (any, error) {
+		ctx, cancel := context.WithTimeout(detach(ctx), s.loadTimeout)
+		defer cancel()
+
+		data, meta, err := s.db.GetRaw(ctx, key, table)
+		if errors.Is(err, storage.ErrNotFound) {
+			go s.populateNotFound(detach(ctx), key, table)
+		}
+		if err != nil {
+			return nil, err
+		}
+		go s.populate(detach(ctx), key, table, data, meta)
+		return data, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-loaded:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.([]byte), nil
+	}
+}
+
+func (s *storageWithCache) GetWithMeta(ctx context.Context, key string, table string, dest any) (storage.Meta, error) {
+	return s.db.GetWithMeta(ctx, key, table, dest)
+}
+
+// GetMany reads database only for keys missing in cache, records are decoded to dest in order of keys.
+// Records read from database aren't put to cache: batch read returns them decoded and without expiry,
+// so cached value could outlive its record. Get of such key populates cache
 func (s *storageWithCache) GetMany(ctx context.Context, keys []string, table string, dest ...any) error {
-	var err error
-	err = s.cache.GetMany(ctx, keys, table, dest)
-	if err != nil && err != redis.Nil {
-		return err
+	lookups, err := s.cache.GetMany(ctx, keys, table, dest...)
+	if err != nil {
+		logCacheError(ctx, "failed get many from cache", "", table, err)
+		return s.db.GetMany(ctx, keys, table, dest...)
 	}
-	if err == redis.Nil {
+
+	var (
+		missKeys []string
+		missDest []any
+		notFound = make(map[string]struct{})
+	)
+	for i, lookup := range lookups {
+		switch lookup {
+		case cache.LookupMiss:
+			missKeys = append(missKeys, keys[i])
+			missDest = append(missDest, dest[i])
+		case cache.LookupStale:
+			s.revalidate(ctx, keys[i], table)
+		case cache.LookupNegative:
+			notFound[keys[i]] = struct{}{}
+		}
+	}
+
+	if len(missKeys) > 0 {
+		err = s.db.GetMany(ctx, missKeys, table, missDest...)
+		var missingErr *storage.MissingKeysError
+		if errors.As(err, &missingErr) {
+			for _, key := range missingErr.Keys {
+				notFound[key] = struct{}{}
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if len(notFound) == 0 {
 		return nil
 	}
-	err = s.db.GetMany(ctx, keys, table, dest)
-	if err != nil {
-		return err
+	missing := make([]string, 0, len(notFound))
+	for _, key := range keys {
+		if _, ok := notFound[key]; ok {
+			missing = append(missing, key)
+		}
 	}
-	return nil
+	return &storage.MissingKeysError{Table: table, Keys: missing}
 }
 
-func (s *storageWithCache) Save(ctx context.Context, key string, data any, table string) error {
-	g, errCtx := errgroup.WithContext(ctx)
-	g.Go(func() error {
-		mErr := s.cache.Save(errCtx, key, data, table)
-		if mErr != nil {
-			return mErr
+// List reads database only, cache can't tell which keys exist
+func (s *storageWithCache) List(ctx context.Context, table string, prefix string, pageToken string, limit int) ([]storage.Item, string, error) {
+	return s.db.List(ctx, table, prefix, pageToken, limit)
+}
+
+// revalidate refreshes stale value in background, only one refresh of key runs at once
+func (s *storageWithCache) revalidate(ctx context.Context, key string, table string) {
+	// cache is ahead of database until queued writes are flushed
+	if s.writePolicy == WriteBehind {
+		return
+	}
+	refreshKey := table + "/" + key
+	if _, running := s.refreshing.LoadOrStore(refreshKey, struct{}{}); running {
+		return
+	}
+
+	go func(ctx context.Context) {
+		defer s.refreshing.Delete(refreshKey)
+
+		data, meta, err := s.db.GetRaw(ctx, key, table)
+		if errors.Is(err, storage.ErrNotFound) {
+			err = s.cache.Delete(ctx, key, table)
+		} else if err == nil {
+			err = s.cache.Refresh(ctx, key, table, data, ttlUntil(meta.ExpiresAt))
 		}
-		return nil
-	})
-	g.Go(func() error {
-		mErr := s.cache.Save(errCtx, key, data, table)
-		if mErr != nil {
-			return mErr
+		if err != nil {
+			logCacheError(ctx, "failed revalidate cache", key, table, err)
 		}
-		return nil
-	})
-	err := g.Wait()
+	}(detach(ctx))
+}
+
+// logCacheError skips failures of degraded cache, they are expected until redis recovers
+func logCacheError(ctx context.Context, message string, key string, table string, err error) {
+	if errors.Is(err, cache.ErrUnavailable) {
+		return
+	}
+	logger.ErrorKV(ctx, message, "key", key, "table", table, "error", err)
+}
+
+// detach keeps span of ctx for work which must outlive request
+func detach(ctx context.Context) context.Context {
+	return trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+}
+
+// ttlUntil returns zero for record which never expires
+func ttlUntil(expiresAt time.Time) time.Duration {
+	if expiresAt.IsZero() {
+		return 0
+	}
+	return time.Until(expiresAt)
+}
+
+func (s *storageWithCache) populateNotFound(ctx context.Context, key string, table string) {
+	err := s.cache.SaveNotFound(ctx, key, table)
+	if err != nil {
+		logCacheError(ctx, "failed populate cache", key, table, err)
+	}
+}
+
+// populate doesn't fail read, value is already loaded from database
+func (s *storageWithCache) populate(ctx context.Context, key string, table string, data []byte, meta storage.Meta) {
+	var ttl time.Duration
+	if !meta.ExpiresAt.IsZero() {
+		ttl = time.Until(meta.ExpiresAt)
+		if ttl <= 0 {
+			return
+		}
+	}
+
+	err := s.cache.Populate(ctx, key, table, data, ttl)
+	if err != nil {
+		logCacheError(ctx, "failed populate cache", key, table, err)
+	}
+}
+
+func (s *storageWithCache) Save(ctx context.Context, key string, data any, table string, opts ...storage.SaveOption) error {
+	if s.writePolicy == WriteBehind {
+		return s.saveBehind(ctx, key, data, table, opts...)
+	}
+
+	err := s.db.Save(ctx, key, data, table, opts...)
 	if err != nil {
 		return err
 	}
+	if s.writePolicy == WriteAround {
+		s.tag(ctx, key, table, opts...)
+		s.invalidate(ctx, key, table)
+		return nil
+	}
+
+	err = s.cache.Save(ctx, key, data, table, opts...)
+	if err != nil {
+		// value is saved, cache just must not keep previous one
+		logCacheError(ctx, "failed update cache", key, table, err)
+		s.invalidate(ctx, key, table)
+	}
 	return nil
 }
 
+// tag remembers tags of written record which isn't cached by write
+func (s *storageWithCache) tag(ctx context.Context, key string, table string, opts ...storage.SaveOption) {
+	err := s.cache.Tag(ctx, key, table, storage.NewSaveOptions(opts...).Tags...)
+	if err != nil {
+		logCacheError(ctx, "failed tag cache key", key, table, err)
+	}
+}
+
+// InvalidateTag drops cached records of tag, database isn't changed
+func (s *storageWithCache) InvalidateTag(ctx context.Context, tag string) error {
+	return s.cache.InvalidateTag(ctx, tag)
+}
+
+// InvalidateTable drops cached records of table, database isn't changed
+func (s *storageWithCache) InvalidateTable(ctx context.Context, table string) error {
+	return s.cache.InvalidateTable(ctx, table)
+}
+
+// invalidate doesn't fail write, cache removes key failed to invalidate by itself when redis recovers
+func (s *storageWithCache) invalidate(ctx context.Context, key string, table string) {
+	err := s.cache.Delete(ctx, key, table)
+	if err != nil {
+		logCacheError(ctx, "failed invalidate cache", key, table, err)
+	}
+}
+
+// SaveIf invalidates cache after successful save, so concurrent writers can't leave stale value in cache.
+// It isn't supported under WriteBehind, revision of database doesn't account for queued writes
+func (s *storageWithCache) SaveIf(
+	ctx context.Context,
+	key string,
+	table string,
+	data any,
+	expectedRevision int64,
+	opts ...storage.SaveOption,
+) (int64, error) {
+	if s.writePolicy == WriteBehind {
+		return 0, fmt.Errorf("conditional save under write-behind policy: %w", storage.ErrUnsupported)
+	}
+	revision, err := s.db.SaveIf(ctx, key, table, data, expectedRevision, opts...)
+	if err != nil {
+		return 0, err
+	}
+	s.tag(ctx, key, table, opts...)
+	s.invalidate(ctx, key, table)
+	return revision, nil
+}
+
 func (s *storageWithCache) Delete(ctx context.Context, key string, table string) error {
-	g, errCtx := errgroup.WithContext(ctx)
-	g.Go(func() error {
-		mErr := s.cache.Delete(errCtx, key, table)
-		if mErr != nil {
-			return mErr
-		}
-		return nil
-	})
-	g.Go(func() error {
-		mErr := s.cache.Delete(errCtx, key, table)
-		if mErr != nil {
-			return mErr
+	if s.writePolicy == WriteBehind {
+		err := s.cache.DeleteBehind(ctx, key, table)
+		if err == nil {
+			return nil
 		}
-		return nil
-	})
-	err := g.Wait()
+		// write can't be queued, so it goes to database directly
+		logCacheError(ctx, "failed delete behind", key, table, err)
+	}
+
+	err := s.db.Delete(ctx, key, table)
 	if err != nil {
 		return err
 	}
+	s.invalidate(ctx, key, table)
 	return nil
 }
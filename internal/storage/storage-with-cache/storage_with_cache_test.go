@@ -0,0 +1,236 @@
+package storage_with_cache
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kjushka/microservice-gen/internal/storage"
+)
+
+// eventually waits for background work of storage, it fails test if cond isn't met in a second
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition isn't met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (c *fakeCache) isNegative(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.negative[key+"-"+testTable]
+	return ok
+}
+
+func (c *fakeCache) markStale(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stale[key+"-"+testTable] = struct{}{}
+}
+
+func (c *fakeCache) refreshCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.refreshes
+}
+
+func (b *fakeBackend) readCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.reads
+}
+
+func TestGet(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("miss populates cache", func(t *testing.T) {
+		s, c, db := newTestStorage(t, WriteThrough)
+		mustSave(t, s, "a", "1")
+		_ = c.Delete(ctx, "a", testTable)
+
+		if value := mustGet(t, s, "a"); value != "1" {
+			t.Fatalf("got '%s', want '1'", value)
+		}
+		eventually(t, func() bool { return c.cached("a") })
+		mustGet(t, s, "a")
+		if reads := db.readCount(); reads != 1 {
+			t.Fatalf("database is read %d times, want 1", reads)
+		}
+	})
+
+	t.Run("missing record is cached as negative entry", func(t *testing.T) {
+		s, c, db := newTestStorage(t, WriteThrough)
+
+		err := s.Get(ctx, "a", testTable, new(string))
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("get error is %v, want %v", err, storage.ErrNotFound)
+		}
+		eventually(t, func() bool { return c.isNegative("a") })
+
+		err = s.Get(ctx, "a", testTable, new(string))
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("get error is %v, want %v", err, storage.ErrNotFound)
+		}
+		if reads := db.readCount(); reads != 1 {
+			t.Fatalf("database is read %d times, want 1", reads)
+		}
+	})
+
+	t.Run("negative hit doesn't read database", func(t *testing.T) {
+		s, c, db := newTestStorage(t, WriteThrough)
+		_ = c.SaveNotFound(ctx, "a", testTable)
+
+		err := s.Get(ctx, "a", testTable, new(string))
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("get error is %v, want %v", err, storage.ErrNotFound)
+		}
+		if reads := db.readCount(); reads != 0 {
+			t.Fatalf("database is read %d times, want 0", reads)
+		}
+	})
+
+	t.Run("save replaces negative entry", func(t *testing.T) {
+		s, c, _ := newTestStorage(t, WriteThrough)
+		_ = c.SaveNotFound(ctx, "a", testTable)
+		mustSave(t, s, "a", "1")
+		if value := mustGet(t, s, "a"); value != "1" {
+			t.Fatalf("got '%s', want '1'", value)
+		}
+	})
+
+	t.Run("stale value is served and refreshed once", func(t *testing.T) {
+		s, c, db := newTestStorage(t, WriteThrough)
+		mustSave(t, s, "a", "1")
+		// database is changed bypassing cache
+		_ = db.Save(ctx, "a", "2", testTable)
+		c.markStale("a")
+		db.loaded = make(chan struct{})
+
+		// refresh waits for database, so every get finds value stale
+		for i := 0; i < 3; i++ {
+			if value := mustGet(t, s, "a"); value != "1" {
+				t.Fatalf("got '%s', want stale '1'", value)
+			}
+		}
+		close(db.loaded)
+
+		eventually(t, func() bool { return c.refreshCount() == 1 })
+		if value := mustGet(t, s, "a"); value != "2" {
+			t.Fatalf("got '%s', want refreshed '2'", value)
+		}
+		if reads := db.readCount(); reads != 1 {
+			t.Fatalf("database is read %d times, want 1", reads)
+		}
+	})
+
+	t.Run("stale value of removed record is dropped", func(t *testing.T) {
+		s, c, db := newTestStorage(t, WriteThrough)
+		mustSave(t, s, "a", "1")
+		_ = db.Delete(ctx, "a", testTable)
+		c.markStale("a")
+
+		mustGet(t, s, "a")
+		eventually(t, func() bool { return !c.cached("a") })
+	})
+
+	t.Run("stale value isn't refreshed under write-behind", func(t *testing.T) {
+		s, c, db := newTestStorage(t, WriteBehind)
+		mustSave(t, s, "a", "1")
+		c.markStale("a")
+
+		if value := mustGet(t, s, "a"); value != "1" {
+			t.Fatalf("got '%s', want '1'", value)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if reads := db.readCount(); reads != 0 {
+			t.Fatalf("database is read %d times, want 0", reads)
+		}
+	})
+}
+
+func TestGetMany(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("cache hits are merged with database reads", func(t *testing.T) {
+		s, c, db := newTestStorage(t, WriteThrough)
+		for key, value := range map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"} {
+			mustSave(t, s, key, value)
+		}
+		// b and d are read from database
+		_ = c.Delete(ctx, "b", testTable)
+		_ = c.Delete(ctx, "d", testTable)
+
+		keys := []string{"d", "a", "b", "c"}
+		values := make([]string, len(keys))
+		dest := make([]any, len(keys))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		err := s.GetMany(ctx, keys, testTable, dest...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"4", "1", "2", "3"}
+		for i := range want {
+			if values[i] != want[i] {
+				t.Fatalf("got %v, want %v", values, want)
+			}
+		}
+		if len(db.manyReads) != 1 || strings.Join(db.manyReads[0], ",") != "d,b" {
+			t.Fatalf("database is read for %v, want [[d b]]", db.manyReads)
+		}
+	})
+
+	t.Run("missing keys are in order of request", func(t *testing.T) {
+		s, c, db := newTestStorage(t, WriteThrough)
+		mustSave(t, s, "a", "1")
+		mustSave(t, s, "b", "2")
+		_ = c.Delete(ctx, "b", testTable)
+		// n is known to be missing by cache, x and y by database
+		_ = c.SaveNotFound(ctx, "n", testTable)
+
+		keys := []string{"x", "a", "n", "b", "y"}
+		values := make([]string, len(keys))
+		dest := make([]any, len(keys))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		err := s.GetMany(ctx, keys, testTable, dest...)
+
+		var missingErr *storage.MissingKeysError
+		if !errors.As(err, &missingErr) || !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("get many error is %v, want missing keys error", err)
+		}
+		if got := strings.Join(missingErr.Keys, ","); got != "x,n,y" {
+			t.Fatalf("missing keys are %s, want x,n,y", got)
+		}
+		if values[1] != "1" || values[3] != "2" {
+			t.Fatalf("got %v, want found records decoded", values)
+		}
+		if len(db.manyReads) != 1 || strings.Join(db.manyReads[0], ",") != "x,b,y" {
+			t.Fatalf("database is read for %v, want [[x b y]]", db.manyReads)
+		}
+	})
+
+	t.Run("cache failure reads database", func(t *testing.T) {
+		s, c, db := newTestStorage(t, WriteThrough)
+		mustSave(t, s, "a", "1")
+		c.failGet = true
+
+		var value string
+		err := s.GetMany(ctx, []string{"a"}, testTable, &value)
+		if err != nil || value != "1" {
+			t.Fatalf("got '%s' with error %v, want '1'", value, err)
+		}
+		if len(db.manyReads) != 1 {
+			t.Fatalf("database is read %d times, want 1", len(db.manyReads))
+		}
+	})
+}
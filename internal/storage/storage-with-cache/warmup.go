@@ -0,0 +1,176 @@
+package storage_with_cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/kjushka/microservice-gen/internal/config"
+	"github.com/kjushka/microservice-gen/internal/logger"
+	"github.com/kjushka/microservice-gen/internal/storage"
+	"github.com/kjushka/microservice-gen/internal/storage/cache"
+	"golang.org/x/sync/errgroup"
+)
+
+const warmUpProgressInterval = 5 * time.Second
+
+// WarmUpOptions describes records loaded to cache on startup
+type WarmUpOptions struct {
+	// Recent last changed records of every table from Tables are loaded
+	Tables []string
+	Recent int
+	// Keys are listed keys by table, they are loaded first
+	Keys        map[string][]string
+	Concurrency int
+}
+
+// WarmUpOptionsFromConfig reads listed keys from keys file, it is json object of keys by table
+func WarmUpOptionsFromConfig(cfg *config.Config) (WarmUpOptions, error) {
+	opts := WarmUpOptions{
+		Tables:      cfg.CacheWarmUpTables,
+		Recent:      cfg.CacheWarmUpRecent,
+		Concurrency: cfg.CacheWarmUpConcurrency,
+	}
+	if opts.Concurrency <= 0 {
+		return WarmUpOptions{}, errors.New("warm-up concurrency must be positive")
+	}
+	if cfg.CacheWarmUpKeysFile == "" {
+		return opts, nil
+	}
+
+	data, err := os.ReadFile(cfg.CacheWarmUpKeysFile)
+	if err != nil {
+		return WarmUpOptions{}, fmt.Errorf("failed read warm-up keys file: %v", err)
+	}
+	err = json.Unmarshal(data, &opts.Keys)
+	if err != nil {
+		return WarmUpOptions{}, fmt.Errorf("failed parse warm-up keys file: %v", err)
+	}
+
+	return opts, nil
+}
+
+type warmUpKey struct {
+	table string
+	key   string
+}
+
+// WarmUp loads records from database to cache with bounded concurrency until all of them are loaded
+// or ctx is done. Cached values aren't overwritten, missing records are skipped
+func WarmUp(ctx context.Context, c cache.Cache, db Backend, opts WarmUpOptions) error {
+	if c.Degraded() {
+		return cache.ErrUnavailable
+	}
+
+	keys, err := warmUpKeys(ctx, db, opts)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	var loaded, failed atomic.Int64
+	logProgress := func(message string) {
+		logger.InfoKV(ctx, message, "loaded", loaded.Load(), "failed", failed.Load(), "total", len(keys))
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(warmUpProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				logProgress("cache warm-up progress")
+			}
+		}
+	}()
+
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(opts.Concurrency)
+	for _, k := range keys {
+		if gCtx.Err() != nil {
+			break
+		}
+		k := k
+		g.Go(func() error {
+			err := warmUpRecord(gCtx, c, db, k)
+			// there is no sense to continue without cache
+			if errors.Is(err, cache.ErrUnavailable) {
+				return err
+			}
+			if err != nil {
+				failed.Add(1)
+				if gCtx.Err() == nil {
+					logger.ErrorKV(gCtx, "failed warm up record", "key", k.key, "table", k.table, "error", err)
+				}
+				return nil
+			}
+			loaded.Add(1)
+			return nil
+		})
+	}
+	err = g.Wait()
+	logProgress("cache warm-up finished")
+	if err != nil {
+		return err
+	}
+
+	return ctx.Err()
+}
+
+// warmUpKeys returns listed keys, then recent keys of tables without duplicates
+func warmUpKeys(ctx context.Context, db Backend, opts WarmUpOptions) ([]warmUpKey, error) {
+	var keys []warmUpKey
+	seen := make(map[warmUpKey]struct{})
+	add := func(table string, tableKeys []string) {
+		for _, key := range tableKeys {
+			k := warmUpKey{table: table, key: key}
+			if _, ok := seen[k]; ok {
+				continue
+			}
+			seen[k] = struct{}{}
+			keys = append(keys, k)
+		}
+	}
+
+	for table, tableKeys := range opts.Keys {
+		add(table, tableKeys)
+	}
+	if opts.Recent <= 0 {
+		return keys, nil
+	}
+	for _, table := range opts.Tables {
+		recent, err := db.RecentKeys(ctx, table, opts.Recent)
+		if err != nil {
+			return nil, fmt.Errorf("failed get recent keys of '%s': %v", table, err)
+		}
+		add(table, recent)
+	}
+
+	return keys, nil
+}
+
+func warmUpRecord(ctx context.Context, c cache.Cache, db Backend, k warmUpKey) error {
+	data, meta, err := db.GetRaw(ctx, k.key, k.table)
+	// record was removed after keys were listed
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	ttl := ttlUntil(meta.ExpiresAt)
+	if !meta.ExpiresAt.IsZero() && ttl <= 0 {
+		return nil
+	}
+	return c.Populate(ctx, k.key, k.table, data, ttl)
+}
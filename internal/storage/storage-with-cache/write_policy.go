@@ -0,0 +1,244 @@
+package storage_with_cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kjushka/microservice-gen/internal/logger"
+	"github.com/kjushka/microservice-gen/internal/storage"
+	"github.com/kjushka/microservice-gen/internal/storage/cache"
+	"github.com/kjushka/microservice-gen/internal/storage/database"
+)
+
+// WritePolicy defines how Save and Delete reach cache and database.
+// SaveIf writes database first and invalidates cache, conditional write needs source of truth
+type WritePolicy int
+
+const (
+	// WriteThrough writes database, then cache. Successful write is durable and visible in cache,
+	// concurrent writes of one key may leave older value in cache until it expires
+	WriteThrough WritePolicy = iota
+	// WriteAround writes database and invalidates cache, next read loads value from database.
+	// Successful write is durable, cache never holds value older than last write finished before read started
+	WriteAround
+	// WriteBehind writes cache and queues write in redis stream in one transaction, queue is flushed
+	// to database in batches in background by the only instance holding flusher lease. Successful write is as durable as redis is, reads see it
+	// while value is in cache. Database and reads after cache eviction lag behind until queue is flushed,
+	// record keeps moment of expiry fixed at save however late it is flushed.
+	// SaveIf fails with storage.ErrUnsupported, writes queued before it would overwrite it. While redis is unavailable writes go
+	// to database directly and may be overwritten by writes queued before outage
+	WriteBehind
+)
+
+var writePolicies = map[string]WritePolicy{
+	"write-through": WriteThrough,
+	"write-around":  WriteAround,
+	"write-behind":  WriteBehind,
+}
+
+func ParseWritePolicy(name string) (WritePolicy, error) {
+	policy, ok := writePolicies[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown write policy '%s'", name)
+	}
+	return policy, nil
+}
+
+type Option func(s *storageWithCache)
+
+// WithWritePolicy sets write policy, default is WriteThrough
+func WithWritePolicy(policy WritePolicy) Option {
+	return func(s *storageWithCache) {
+		s.writePolicy = policy
+	}
+}
+
+// WithLoadTimeout limits database query shared by concurrent cache misses of key, default is 5s
+func WithLoadTimeout(timeout time.Duration) Option {
+	return func(s *storageWithCache) {
+		if timeout > 0 {
+			s.loadTimeout = timeout
+		}
+	}
+}
+
+const defaultLoadTimeout = 5 * time.Second
+
+const (
+	flushBatch      = 500
+	flushBlock      = time.Second
+	flushRetryDelay = time.Second
+	// retry delay doubles after every failed flush up to this value, so database outage
+	// of about a quarter of hour is waited out before writes start to go to dead letter stream
+	flushMaxRetryDelay = time.Minute
+	// write which failed to flush this many times is moved to dead letter stream
+	maxFlushAttempts = 20
+	// flushLease is lease of the only flusher. Flush of holder ends within half of lease,
+	// so it is done before other instance can take expired lease
+	flushLease = 30 * time.Second
+)
+
+// saveBehind fixes moment of expiry at save, so record flushed later expires together with its cached value
+func (s *storageWithCache) saveBehind(ctx context.Context, key string, data any, table string, opts ...storage.SaveOption) error {
+	if o := storage.NewSaveOptions(opts...); o.TTL > 0 && o.ExpiresAt.IsZero() {
+		opts = append(opts, storage.WithExpiresAt(time.Now().Add(o.TTL)))
+	}
+	buf := bytes.NewBuffer(nil)
+	err := s.db.Serializer().Encode(buf, data)
+	if err != nil {
+		return fmt.Errorf("failed encode data: %v", err)
+	}
+	err = s.cache.SaveBehind(ctx, key, table, buf.Bytes(), opts...)
+	if err == nil {
+		return nil
+	}
+
+	// write can't be queued, so it goes to database directly
+	logCacheError(ctx, "failed save behind", key, table, err)
+	err = s.db.Save(ctx, key, data, table, opts...)
+	if err != nil {
+		return err
+	}
+	s.tag(ctx, key, table, opts...)
+	s.invalidate(ctx, key, table)
+	return nil
+}
+
+// runFlusher moves queued writes to database until ctx is done. Every write is applied at least once,
+// write is queued again if flusher dies before acknowledging it. Flushers of all instances compete
+// for lease, concurrent flushers could apply older write of key after newer one
+func (s *storageWithCache) runFlusher(ctx context.Context) {
+	consumer, err := os.Hostname()
+	if err != nil {
+		consumer = fmt.Sprintf("flusher-%d", os.Getpid())
+	}
+	defer func() {
+		// other instance takes lease at once instead of waiting for its expiration
+		err := s.cache.ReleaseBehindLease(context.Background(), consumer)
+		if err != nil && !errors.Is(err, cache.ErrUnavailable) {
+			logger.ErrorKV(ctx, "failed release flusher lease", "error", err)
+		}
+	}()
+
+	delay := flushRetryDelay
+	for ctx.Err() == nil {
+		leader, err := s.cache.AcquireBehindLease(ctx, consumer, flushLease)
+		if err == nil && !leader {
+			select {
+			case <-ctx.Done():
+			case <-time.After(flushLease / 3):
+			}
+			continue
+		}
+		if err == nil {
+			flushCtx, cancel := context.WithTimeout(ctx, flushLease/2)
+			err = s.flush(flushCtx, consumer)
+			cancel()
+		}
+		if err == nil || ctx.Err() != nil {
+			delay = flushRetryDelay
+			continue
+		}
+		if !errors.Is(err, cache.ErrUnavailable) {
+			logger.ErrorKV(ctx, "failed flush queued writes", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > flushMaxRetryDelay {
+			delay = flushMaxRetryDelay
+		}
+	}
+}
+
+func (s *storageWithCache) flush(ctx context.Context, consumer string) error {
+	queued, err := s.cache.ReadBehind(ctx, consumer, flushBatch, flushBlock)
+	if err != nil {
+		return err
+	}
+	if len(queued) == 0 {
+		return nil
+	}
+
+	ctx, span := s.tracer.Start(ctx, "flush queued writes")
+	defer span.End()
+
+	writes := make([]database.Write, 0, len(queued))
+	ids := make([]string, 0, len(queued))
+	for _, q := range queued {
+		writes = append(writes, databaseWrite(q))
+		ids = append(ids, q.ID)
+	}
+
+	err = s.db.WriteBatch(ctx, writes)
+	if err == nil {
+		return s.cache.AckBehind(ctx, ids...)
+	}
+	if ctx.Err() != nil {
+		return err
+	}
+	// one bad write mustn't block whole queue, so writes of failed batch are applied one by one
+	return s.flushEach(ctx, queued)
+}
+
+// flushEach applies writes one at a time. Write failed maxFlushAttempts times is moved to dead letter
+// stream, later writes of its key wait for it in queue, so writes of key are applied in queued order
+func (s *storageWithCache) flushEach(ctx context.Context, queued []cache.QueuedWrite) error {
+	var (
+		flushed []string
+		blocked = make(map[string]struct{})
+		lastErr error
+	)
+	for _, q := range queued {
+		recordKey := q.Table + "/" + q.Key
+		if _, ok := blocked[recordKey]; ok {
+			continue
+		}
+
+		err := s.db.WriteBatch(ctx, []database.Write{databaseWrite(q)})
+		if err == nil {
+			flushed = append(flushed, q.ID)
+			continue
+		}
+		if ctx.Err() != nil {
+			lastErr = err
+			break
+		}
+		if q.Deliveries >= maxFlushAttempts {
+			logger.ErrorKV(ctx, "queued write is moved to dead letter stream",
+				"key", q.Key, "table", q.Table, "id", q.ID, "attempts", q.Deliveries, "error", err)
+			err = s.cache.DeadLetterBehind(ctx, q, err)
+			if err == nil {
+				continue
+			}
+		}
+		blocked[recordKey] = struct{}{}
+		lastErr = err
+	}
+
+	if len(flushed) > 0 {
+		err := s.cache.AckBehind(ctx, flushed...)
+		if err != nil {
+			return err
+		}
+	}
+	if lastErr != nil {
+		return fmt.Errorf("failed flush %d of %d writes: %w", len(queued)-len(flushed), len(queued), lastErr)
+	}
+	return nil
+}
+
+func databaseWrite(q cache.QueuedWrite) database.Write {
+	return database.Write{
+		Key:       q.Key,
+		Table:     q.Table,
+		Data:      q.Data,
+		ExpiresAt: q.ExpiresAt,
+		Delete:    q.Delete,
+	}
+}
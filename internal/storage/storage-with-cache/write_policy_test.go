@@ -0,0 +1,675 @@
+package storage_with_cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kjushka/microservice-gen/internal/storage"
+	"github.com/kjushka/microservice-gen/internal/storage/cache"
+	"github.com/kjushka/microservice-gen/internal/storage/database"
+	"github.com/kjushka/microservice-gen/internal/storage/serializer"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const testTable = "values"
+
+var errTestFailure = errors.New("test failure")
+
+// fakeCache keeps encoded values and queued writes in memory, methods not used by tests panic
+type fakeCache struct {
+	cache.Cache
+
+	mu         sync.Mutex
+	serializer serializer.Serializer
+	values     map[string][]byte
+	// negative keys are known to be missing, stale values are served and refreshed
+	negative  map[string]struct{}
+	stale     map[string]struct{}
+	refreshes int
+	queue     []cache.QueuedWrite
+	dead      []cache.QueuedWrite
+	nextID    int
+	// failSave fails Save and SaveBehind, Delete still works
+	failSave bool
+	// failGet fails reads
+	failGet bool
+}
+
+func newFakeCache(s serializer.Serializer) *fakeCache {
+	return &fakeCache{
+		serializer: s,
+		values:     make(map[string][]byte),
+		negative:   make(map[string]struct{}),
+		stale:      make(map[string]struct{}),
+	}
+}
+
+func (c *fakeCache) Get(ctx context.Context, key string, table string, dest any) error {
+	if c.failGet {
+		return cache.ErrUnavailable
+	}
+	c.mu.Lock()
+	data, ok := c.values[key+"-"+table]
+	_, negative := c.negative[key+"-"+table]
+	_, stale := c.stale[key+"-"+table]
+	c.mu.Unlock()
+	if negative {
+		return cache.ErrNegativeHit
+	}
+	if !ok {
+		return storage.ErrNotFound
+	}
+	err := c.serializer.Decode(bytes.NewReader(data), dest)
+	if err != nil {
+		return err
+	}
+	if stale {
+		return cache.ErrStale
+	}
+	return nil
+}
+
+func (c *fakeCache) GetMany(ctx context.Context, keys []string, table string, dest ...any) ([]cache.Lookup, error) {
+	lookups := make([]cache.Lookup, len(keys))
+	for i, key := range keys {
+		err := c.Get(ctx, key, table, dest[i])
+		switch {
+		case err == nil:
+			lookups[i] = cache.LookupHit
+		case errors.Is(err, cache.ErrStale):
+			lookups[i] = cache.LookupStale
+		case errors.Is(err, cache.ErrNegativeHit):
+			lookups[i] = cache.LookupNegative
+		case errors.Is(err, storage.ErrNotFound):
+			lookups[i] = cache.LookupMiss
+		default:
+			return nil, err
+		}
+	}
+	return lookups, nil
+}
+
+func (c *fakeCache) Save(ctx context.Context, key string, data any, table string, opts ...storage.SaveOption) error {
+	if c.failSave {
+		return cache.ErrUnavailable
+	}
+	buf := bytes.NewBuffer(nil)
+	err := c.serializer.Encode(buf, data)
+	if err != nil {
+		return err
+	}
+	c.set(key, table, buf.Bytes())
+	return nil
+}
+
+func (c *fakeCache) Populate(ctx context.Context, key string, table string, data []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, negative := c.negative[key+"-"+table]
+	if _, ok := c.values[key+"-"+table]; !ok && !negative {
+		c.values[key+"-"+table] = data
+	}
+	return nil
+}
+
+func (c *fakeCache) Refresh(ctx context.Context, key string, table string, data []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.stale[key+"-"+table]; ok {
+		c.values[key+"-"+table] = data
+		delete(c.stale, key+"-"+table)
+		c.refreshes++
+	}
+	return nil
+}
+
+func (c *fakeCache) SaveNotFound(ctx context.Context, key string, table string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.values[key+"-"+table]; !ok {
+		c.negative[key+"-"+table] = struct{}{}
+	}
+	return nil
+}
+
+func (c *fakeCache) Delete(ctx context.Context, key string, table string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.values, key+"-"+table)
+	delete(c.negative, key+"-"+table)
+	delete(c.stale, key+"-"+table)
+	return nil
+}
+
+func (c *fakeCache) Tag(ctx context.Context, key string, table string, tags ...string) error {
+	return nil
+}
+
+func (c *fakeCache) SaveBehind(ctx context.Context, key string, table string, data []byte, opts ...storage.SaveOption) error {
+	if c.failSave {
+		return cache.ErrUnavailable
+	}
+	c.set(key, table, data)
+	c.enqueue(cache.QueuedWrite{Key: key, Table: table, Data: data, ExpiresAt: storage.NewSaveOptions(opts...).ExpiresAt})
+	return nil
+}
+
+func (c *fakeCache) DeleteBehind(ctx context.Context, key string, table string) error {
+	_ = c.Delete(ctx, key, table)
+	c.enqueue(cache.QueuedWrite{Key: key, Table: table, Delete: true})
+	return nil
+}
+
+// ReadBehind returns every not acknowledged write, each read is a delivery
+func (c *fakeCache) ReadBehind(ctx context.Context, consumer string, count int64, block time.Duration) ([]cache.QueuedWrite, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var writes []cache.QueuedWrite
+	for i := range c.queue {
+		if int64(len(writes)) == count {
+			break
+		}
+		c.queue[i].Deliveries++
+		writes = append(writes, c.queue[i])
+	}
+	return writes, nil
+}
+
+func (c *fakeCache) AckBehind(ctx context.Context, ids ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range ids {
+		c.remove(id)
+	}
+	return nil
+}
+
+func (c *fakeCache) DeadLetterBehind(ctx context.Context, write cache.QueuedWrite, reason error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(write.ID)
+	c.dead = append(c.dead, write)
+	delete(c.values, write.Key+"-"+write.Table)
+	delete(c.stale, write.Key+"-"+write.Table)
+	return nil
+}
+
+func (c *fakeCache) set(key string, table string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key+"-"+table] = data
+	delete(c.negative, key+"-"+table)
+	delete(c.stale, key+"-"+table)
+}
+
+func (c *fakeCache) enqueue(w cache.QueuedWrite) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	w.ID = fmt.Sprintf("%d-0", c.nextID)
+	c.queue = append(c.queue, w)
+}
+
+func (c *fakeCache) remove(id string) {
+	for i, w := range c.queue {
+		if w.ID == id {
+			c.queue = append(c.queue[:i], c.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *fakeCache) cached(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.values[key+"-"+testTable]
+	return ok
+}
+
+func (c *fakeCache) queued() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.queue)
+}
+
+// fakeBackend keeps encoded records in memory, methods not used by tests panic
+type fakeBackend struct {
+	Backend
+
+	mu         sync.Mutex
+	serializer serializer.Serializer
+	records    map[string][]byte
+	expiries   map[string]time.Time
+	// fail fails write of record, batch is applied entirely or not at all
+	fail func(w database.Write) error
+	// reads wait for loaded if it isn't nil
+	loaded chan struct{}
+	reads  int
+	// keys requested by every GetMany
+	manyReads [][]string
+}
+
+func newFakeBackend(s serializer.Serializer) *fakeBackend {
+	return &fakeBackend{serializer: s, records: make(map[string][]byte), expiries: make(map[string]time.Time)}
+}
+
+func (b *fakeBackend) Serializer() serializer.Serializer {
+	return b.serializer
+}
+
+func (b *fakeBackend) GetRaw(ctx context.Context, key string, table string) ([]byte, storage.Meta, error) {
+	if b.loaded != nil {
+		select {
+		case <-ctx.Done():
+			return nil, storage.Meta{}, ctx.Err()
+		case <-b.loaded:
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reads++
+	data, ok := b.records[table+"/"+key]
+	if !ok {
+		return nil, storage.Meta{}, storage.ErrNotFound
+	}
+	return data, storage.Meta{}, nil
+}
+
+func (b *fakeBackend) GetMany(ctx context.Context, keys []string, table string, dest ...any) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.manyReads = append(b.manyReads, keys)
+	var missing []string
+	for i, key := range keys {
+		data, ok := b.records[table+"/"+key]
+		if !ok {
+			missing = append(missing, key)
+			continue
+		}
+		err := b.serializer.Decode(bytes.NewReader(data), dest[i])
+		if err != nil {
+			return err
+		}
+	}
+	if len(missing) > 0 {
+		return &storage.MissingKeysError{Table: table, Keys: missing}
+	}
+	return nil
+}
+
+func (b *fakeBackend) Save(ctx context.Context, key string, data any, table string, opts ...storage.SaveOption) error {
+	buf := bytes.NewBuffer(nil)
+	err := b.serializer.Encode(buf, data)
+	if err != nil {
+		return err
+	}
+	return b.WriteBatch(ctx, []database.Write{{Key: key, Table: table, Data: buf.Bytes()}})
+}
+
+func (b *fakeBackend) Delete(ctx context.Context, key string, table string) error {
+	return b.WriteBatch(ctx, []database.Write{{Key: key, Table: table, Delete: true}})
+}
+
+func (b *fakeBackend) WriteBatch(ctx context.Context, writes []database.Write) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.fail != nil {
+		for _, w := range writes {
+			if err := b.fail(w); err != nil {
+				return err
+			}
+		}
+	}
+	for _, w := range writes {
+		if w.Delete {
+			delete(b.records, w.Table+"/"+w.Key)
+			delete(b.expiries, w.Table+"/"+w.Key)
+		} else {
+			b.records[w.Table+"/"+w.Key] = w.Data
+			b.expiries[w.Table+"/"+w.Key] = w.ExpiresAt
+		}
+	}
+	return nil
+}
+
+func (b *fakeBackend) value(t *testing.T, key string) (string, bool) {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, ok := b.records[testTable+"/"+key]
+	if !ok {
+		return "", false
+	}
+	var value string
+	err := b.serializer.Decode(bytes.NewReader(data), &value)
+	if err != nil {
+		t.Fatalf("decode record '%s': %v", key, err)
+	}
+	return value, true
+}
+
+func newTestStorage(t *testing.T, policy WritePolicy) (*storageWithCache, *fakeCache, *fakeBackend) {
+	t.Helper()
+	s, err := serializer.New("json")
+	if err != nil {
+		t.Fatalf("create serializer: %v", err)
+	}
+	c := newFakeCache(s)
+	db := newFakeBackend(s)
+	return &storageWithCache{
+		cache:       c,
+		db:          db,
+		writePolicy: policy,
+		loadTimeout: defaultLoadTimeout,
+		tracer:      trace.NewNoopTracerProvider().Tracer("test"),
+	}, c, db
+}
+
+func mustGet(t *testing.T, s *storageWithCache, key string) string {
+	t.Helper()
+	var value string
+	err := s.Get(context.Background(), key, testTable, &value)
+	if err != nil {
+		t.Fatalf("get '%s': %v", key, err)
+	}
+	return value
+}
+
+func mustSave(t *testing.T, s *storageWithCache, key string, value string) {
+	t.Helper()
+	err := s.Save(context.Background(), key, value, testTable)
+	if err != nil {
+		t.Fatalf("save '%s': %v", key, err)
+	}
+}
+
+func TestWriteThrough(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("get after save", func(t *testing.T) {
+		s, c, db := newTestStorage(t, WriteThrough)
+		mustSave(t, s, "a", "1")
+		if !c.cached("a") {
+			t.Fatal("saved value isn't cached")
+		}
+		if value, _ := db.value(t, "a"); value != "1" {
+			t.Fatalf("database holds '%s', want '1'", value)
+		}
+		if value := mustGet(t, s, "a"); value != "1" {
+			t.Fatalf("got '%s', want '1'", value)
+		}
+	})
+
+	t.Run("database failure keeps cached value", func(t *testing.T) {
+		s, c, db := newTestStorage(t, WriteThrough)
+		mustSave(t, s, "a", "1")
+		db.fail = func(database.Write) error { return errTestFailure }
+
+		err := s.Save(ctx, "a", "2", testTable)
+		if !errors.Is(err, errTestFailure) {
+			t.Fatalf("save error is %v, want %v", err, errTestFailure)
+		}
+		if !c.cached("a") {
+			t.Fatal("value matching database is invalidated")
+		}
+		if value := mustGet(t, s, "a"); value != "1" {
+			t.Fatalf("got '%s', want '1'", value)
+		}
+	})
+
+	t.Run("cache failure invalidates key", func(t *testing.T) {
+		s, c, _ := newTestStorage(t, WriteThrough)
+		mustSave(t, s, "a", "1")
+		c.failSave = true
+
+		mustSave(t, s, "a", "2")
+		if c.cached("a") {
+			t.Fatal("previous value is left in cache")
+		}
+		if value := mustGet(t, s, "a"); value != "2" {
+			t.Fatalf("got '%s', want '2'", value)
+		}
+	})
+}
+
+func TestWriteAround(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("get after save", func(t *testing.T) {
+		s, c, _ := newTestStorage(t, WriteAround)
+		mustSave(t, s, "a", "1")
+		if value := mustGet(t, s, "a"); value != "1" {
+			t.Fatalf("got '%s', want '1'", value)
+		}
+
+		mustSave(t, s, "a", "2")
+		if c.cached("a") {
+			t.Fatal("save doesn't invalidate cache")
+		}
+		if value := mustGet(t, s, "a"); value != "2" {
+			t.Fatalf("got '%s', want '2'", value)
+		}
+	})
+
+	t.Run("database failure keeps cached value", func(t *testing.T) {
+		s, c, db := newTestStorage(t, WriteAround)
+		mustSave(t, s, "a", "1")
+		data, _, _ := db.GetRaw(ctx, "a", testTable)
+		c.set("a", testTable, data)
+		db.fail = func(database.Write) error { return errTestFailure }
+
+		err := s.Save(ctx, "a", "2", testTable)
+		if !errors.Is(err, errTestFailure) {
+			t.Fatalf("save error is %v, want %v", err, errTestFailure)
+		}
+		if !c.cached("a") {
+			t.Fatal("value matching database is invalidated")
+		}
+		if value := mustGet(t, s, "a"); value != "1" {
+			t.Fatalf("got '%s', want '1'", value)
+		}
+	})
+}
+
+func TestWriteBehind(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("get after save", func(t *testing.T) {
+		s, c, db := newTestStorage(t, WriteBehind)
+		mustSave(t, s, "a", "1")
+		if value := mustGet(t, s, "a"); value != "1" {
+			t.Fatalf("got '%s', want '1'", value)
+		}
+		if _, ok := db.value(t, "a"); ok {
+			t.Fatal("database is written before flush")
+		}
+
+		err := s.flush(ctx, "test")
+		if err != nil {
+			t.Fatalf("flush: %v", err)
+		}
+		if value, _ := db.value(t, "a"); value != "1" {
+			t.Fatalf("database holds '%s', want '1'", value)
+		}
+		if c.queued() != 0 {
+			t.Fatal("flushed write is left in queue")
+		}
+	})
+
+	t.Run("queue failure writes database", func(t *testing.T) {
+		s, c, db := newTestStorage(t, WriteBehind)
+		c.failSave = true
+
+		mustSave(t, s, "a", "1")
+		if value, _ := db.value(t, "a"); value != "1" {
+			t.Fatalf("database holds '%s', want '1'", value)
+		}
+		if c.cached("a") {
+			t.Fatal("value written bypassing queue is left in cache")
+		}
+	})
+
+	t.Run("failed flush is redelivered", func(t *testing.T) {
+		s, c, db := newTestStorage(t, WriteBehind)
+		mustSave(t, s, "a", "1")
+		mustSave(t, s, "b", "2")
+		db.fail = func(database.Write) error { return errTestFailure }
+
+		err := s.flush(ctx, "test")
+		if !errors.Is(err, errTestFailure) {
+			t.Fatalf("flush error is %v, want %v", err, errTestFailure)
+		}
+		if c.queued() != 2 {
+			t.Fatalf("%d writes are queued after failed flush, want 2", c.queued())
+		}
+
+		db.fail = nil
+		err = s.flush(ctx, "test")
+		if err != nil {
+			t.Fatalf("flush: %v", err)
+		}
+		for key, want := range map[string]string{"a": "1", "b": "2"} {
+			if value, _ := db.value(t, key); value != want {
+				t.Fatalf("database holds '%s' for '%s', want '%s'", value, key, want)
+			}
+		}
+		if c.queued() != 0 {
+			t.Fatal("flushed writes are left in queue")
+		}
+	})
+
+	t.Run("delete queued behind save", func(t *testing.T) {
+		s, c, db := newTestStorage(t, WriteBehind)
+		mustSave(t, s, "a", "1")
+		err := s.Delete(ctx, "a", testTable)
+		if err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+		if c.cached("a") {
+			t.Fatal("deleted value is left in cache")
+		}
+
+		err = s.flush(ctx, "test")
+		if err != nil {
+			t.Fatalf("flush: %v", err)
+		}
+		if _, ok := db.value(t, "a"); ok {
+			t.Fatal("save is applied after delete queued behind it")
+		}
+		err = s.Get(ctx, "a", testTable, new(string))
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("get error is %v, want %v", err, storage.ErrNotFound)
+		}
+	})
+
+	t.Run("poison write goes to dead letter stream", func(t *testing.T) {
+		s, c, db := newTestStorage(t, WriteBehind)
+		mustSave(t, s, "a", "1")
+		mustSave(t, s, "poison", "x")
+		mustSave(t, s, "poison", "y")
+		mustSave(t, s, "b", "2")
+		db.fail = func(w database.Write) error {
+			var value string
+			_ = db.serializer.Decode(bytes.NewReader(w.Data), &value)
+			if value == "x" {
+				return errTestFailure
+			}
+			return nil
+		}
+
+		err := s.flush(ctx, "test")
+		if !errors.Is(err, errTestFailure) {
+			t.Fatalf("flush error is %v, want %v", err, errTestFailure)
+		}
+		if value, _ := db.value(t, "b"); value != "2" {
+			t.Fatalf("write behind poison one isn't flushed, database holds '%s'", value)
+		}
+		if _, ok := db.value(t, "poison"); ok {
+			t.Fatal("later write of key is applied before failed one")
+		}
+
+		for i := 1; i < maxFlushAttempts; i++ {
+			err = s.flush(ctx, "test")
+		}
+		if err != nil {
+			t.Fatalf("flush after dead lettering: %v", err)
+		}
+		if len(c.dead) != 1 || c.dead[0].Key != "poison" {
+			t.Fatalf("dead letters are %+v, want poison write", c.dead)
+		}
+		if value, _ := db.value(t, "poison"); value != "y" {
+			t.Fatalf("database holds '%s' for poison key, want 'y'", value)
+		}
+		if c.queued() != 0 {
+			t.Fatalf("%d writes are left in queue", c.queued())
+		}
+	})
+
+	t.Run("delayed flush keeps expiry of save", func(t *testing.T) {
+		s, _, db := newTestStorage(t, WriteBehind)
+		const ttl = time.Hour
+		savedAfter := time.Now()
+		err := s.Save(ctx, "a", "1", testTable, storage.WithTTL(ttl))
+		if err != nil {
+			t.Fatalf("save: %v", err)
+		}
+		savedBefore := time.Now()
+
+		db.fail = func(database.Write) error { return errTestFailure }
+		_ = s.flush(ctx, "test")
+		time.Sleep(50 * time.Millisecond)
+		db.fail = nil
+		err = s.flush(ctx, "test")
+		if err != nil {
+			t.Fatalf("flush: %v", err)
+		}
+
+		db.mu.Lock()
+		expiresAt := db.expiries[testTable+"/a"]
+		db.mu.Unlock()
+		if expiresAt.Before(savedAfter.Add(ttl)) || expiresAt.After(savedBefore.Add(ttl)) {
+			t.Fatalf("flushed record expires at %v, want expiry of save within [%v, %v]",
+				expiresAt, savedAfter.Add(ttl), savedBefore.Add(ttl))
+		}
+	})
+
+	t.Run("conditional save is rejected", func(t *testing.T) {
+		s, _, _ := newTestStorage(t, WriteBehind)
+		_, err := s.SaveIf(ctx, "a", testTable, "1", 0)
+		if !errors.Is(err, storage.ErrUnsupported) {
+			t.Fatalf("save if error is %v, want %v", err, storage.ErrUnsupported)
+		}
+	})
+}
+
+func TestLoadOutlivesCancelledCaller(t *testing.T) {
+	s, c, db := newTestStorage(t, WriteThrough)
+	mustSave(t, s, "a", "1")
+	_ = c.Delete(context.Background(), "a", testTable)
+	db.loaded = make(chan struct{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		first <- s.Get(ctx, "a", testTable, new(string))
+	}()
+	var value string
+	second := make(chan error)
+	go func() {
+		second <- s.Get(context.Background(), "a", testTable, &value)
+	}()
+
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled get error is %v, want %v", err, context.Canceled)
+	}
+	close(db.loaded)
+	if err := <-second; err != nil || value != "1" {
+		t.Fatalf("got '%s' with error %v, want '1'", value, err)
+	}
+}
@@ -1,14 +1,206 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
 )
 
 type Storage interface {
 	// need send pointer to dest
 	Get(ctx context.Context, key string, table string, dest any) error
-	// need send pointer to dest
+	// need send pointer to dest, reads source of truth and returns metadata of record
+	GetWithMeta(ctx context.Context, key string, table string, dest any) (Meta, error)
+	// need send pointer to dest, returns MissingKeysError if some of records are missing
 	GetMany(ctx context.Context, keys []string, table string, dest ...any) error
-	Save(ctx context.Context, key string, data any, table string) error
+	Save(ctx context.Context, key string, data any, table string, opts ...SaveOption) error
+	// SaveIf saves data only if record has expectedRevision, zero expectedRevision means
+	// record must not exist. Returns new revision or ConflictError
+	SaveIf(ctx context.Context, key string, table string, data any, expectedRevision int64, opts ...SaveOption) (int64, error)
 	Delete(ctx context.Context, key string, table string) error
+	// List returns up to limit records of table with key prefix ordered by key and token of next page,
+	// empty pageToken means first page, empty next token means last page. Limit must be positive
+	List(ctx context.Context, table string, prefix string, pageToken string, limit int) ([]Item, string, error)
+}
+
+// Invalidator drops cached records which became stale because database was changed bypassing storage
+type Invalidator interface {
+	// InvalidateTag drops every cached record saved with tag
+	InvalidateTag(ctx context.Context, tag string) error
+	// InvalidateTable drops every cached record of table
+	InvalidateTable(ctx context.Context, table string) error
+}
+
+// Meta describes stored record
+type Meta struct {
+	Revision int64
+	// zero if record never expires
+	ExpiresAt time.Time
+}
+
+type SaveOptions struct {
+	// zero means record never expires
+	TTL time.Duration
+	// ExpiresAt overrides TTL, write applied later than it was made keeps its expiry
+	ExpiresAt time.Time
+	// tags group cached records for invalidation, they aren't stored in database
+	Tags []string
+}
+
+type SaveOption func(o *SaveOptions)
+
+// WithTTL makes record expire after ttl
+func WithTTL(ttl time.Duration) SaveOption {
+	return func(o *SaveOptions) {
+		o.TTL = ttl
+	}
+}
+
+// WithExpiresAt makes record expire at moment t, it overrides WithTTL
+func WithExpiresAt(t time.Time) SaveOption {
+	return func(o *SaveOptions) {
+		o.ExpiresAt = t
+	}
+}
+
+// WithTags attaches tags to cached record, record is dropped from cache by invalidation of any of them
+func WithTags(tags ...string) SaveOption {
+	return func(o *SaveOptions) {
+		o.Tags = append(o.Tags, tags...)
+	}
+}
+
+func NewSaveOptions(opts ...SaveOption) SaveOptions {
+	var o SaveOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Item is a record returned by List
+type Item struct {
+	Key      string
+	Revision int64
+
+	data   []byte
+	decode func(r io.Reader, dest any) error
+}
+
+func NewItem(key string, revision int64, data []byte, decode func(r io.Reader, dest any) error) Item {
+	return Item{
+		Key:      key,
+		Revision: revision,
+		data:     data,
+		decode:   decode,
+	}
+}
+
+// Decode needs pointer to dest
+func (i Item) Decode(dest any) error {
+	return i.decode(bytes.NewReader(i.data), dest)
+}
+
+// ErrInvalidPageToken is returned by List for token which wasn't issued by List
+var ErrInvalidPageToken = errors.New("invalid page token")
+
+// ErrInvalidLimit is returned by List for non-positive limit
+var ErrInvalidLimit = errors.New("limit must be positive")
+
+// pageTokenVersion prefixes every page token, so token format could be changed later
+const pageTokenVersion = "v1."
+
+// EncodePageToken makes opaque token from last key of page
+func EncodePageToken(lastKey string) string {
+	return pageTokenVersion + base64.RawURLEncoding.EncodeToString([]byte(lastKey))
+}
+
+// DecodePageToken returns last key of previous page, empty for empty token
+func DecodePageToken(token string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+	encoded, ok := strings.CutPrefix(token, pageTokenVersion)
+	if !ok {
+		return "", ErrInvalidPageToken
+	}
+	lastKey, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", ErrInvalidPageToken
+	}
+	return string(lastKey), nil
+}
+
+// ErrNotFound is returned by every implementation when record is missing, check it with errors.Is
+var ErrNotFound = errors.New("not found")
+
+// MissingKeysError is returned by GetMany when some of records are missing, it matches ErrNotFound.
+// Records of other keys are decoded to dest anyway
+type MissingKeysError struct {
+	Table string
+	// in order of requested keys
+	Keys []string
+}
+
+func (e *MissingKeysError) Error() string {
+	return fmt.Sprintf("keys %v in '%s': %v", e.Keys, e.Table, ErrNotFound)
+}
+
+func (e *MissingKeysError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// ErrUnsupported is returned for operation which configured storage can't do
+var ErrUnsupported = errors.New("operation isn't supported")
+
+// ErrConflict matches every ConflictError with errors.Is
+var ErrConflict = errors.New("revision conflict")
+
+type ConflictError struct {
+	Table            string
+	Key              string
+	ExpectedRevision int64
+	// zero if record doesn't exist
+	ActualRevision int64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf(
+		"revision conflict for key '%s' in '%s': expected %d, actual %d",
+		e.Key, e.Table, e.ExpectedRevision, e.ActualRevision,
+	)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+type EventType int8
+
+const (
+	EventPut EventType = iota + 1
+	EventDelete
+)
+
+// Event describes change of one record
+type Event struct {
+	Type     EventType `json:"type"`
+	Table    string    `json:"table"`
+	Key      string    `json:"key"`
+	Revision int64     `json:"revision"`
+}
+
+// ErrCompacted is returned by Watch if changes after start revision aren't retained anymore
+var ErrCompacted = errors.New("revision is compacted")
+
+type Watcher interface {
+	// Watch calls fn for every change in table of keys with prefix happened after fromRevision,
+	// zero fromRevision means only new changes. Blocks until ctx is done or fn returns error.
+	// Returns ErrCompacted if fromRevision is older than retained changes
+	Watch(ctx context.Context, table string, prefix string, fromRevision int64, fn func(Event) error) error
 }
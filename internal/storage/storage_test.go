@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPageToken(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		for _, lastKey := range []string{"a", "user:1", "key with spaces", "ключ", "\x00\xff"} {
+			got, err := DecodePageToken(EncodePageToken(lastKey))
+			if err != nil {
+				t.Fatalf("decode token of '%s': %v", lastKey, err)
+			}
+			if got != lastKey {
+				t.Fatalf("got '%s', want '%s'", got, lastKey)
+			}
+		}
+	})
+
+	t.Run("empty token is first page", func(t *testing.T) {
+		lastKey, err := DecodePageToken("")
+		if err != nil || lastKey != "" {
+			t.Fatalf("got '%s' with error %v, want empty", lastKey, err)
+		}
+	})
+
+	t.Run("token isn't issued by list", func(t *testing.T) {
+		for _, token := range []string{
+			// raw key
+			"user:1",
+			// encoded key without version
+			"dXNlcjox",
+			// unknown version
+			"v2.dXNlcjox",
+			// invalid encoding
+			"v1.dXNlcjox!",
+		} {
+			_, err := DecodePageToken(token)
+			if !errors.Is(err, ErrInvalidPageToken) {
+				t.Fatalf("decode error of '%s' is %v, want %v", token, err, ErrInvalidPageToken)
+			}
+		}
+	})
+}
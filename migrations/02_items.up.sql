@@ -0,0 +1,5 @@
+create table if not exists items
+(
+    uid  text primary key,
+    data bytea not null
+);
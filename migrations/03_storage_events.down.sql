@@ -0,0 +1,3 @@
+drop trigger if exists storage_events_notify on storage_events;
+drop function if exists notify_storage_event();
+drop table if exists storage_events;
@@ -0,0 +1,29 @@
+create table if not exists storage_events
+(
+    revision   bigserial primary key,
+    tbl        text        not null,
+    uid        text        not null,
+    type       smallint    not null,
+    created_at timestamptz not null default now()
+);
+
+create index if not exists storage_events_tbl_revision_idx on storage_events (tbl, revision);
+
+create or replace function notify_storage_event() returns trigger as
+$$
+begin
+    perform pg_notify('storage_events', json_build_object(
+            'revision', new.revision,
+            'table', new.tbl,
+            'key', new.uid,
+            'type', new.type
+        )::text);
+    return new;
+end;
+$$ language plpgsql;
+
+create trigger storage_events_notify
+    after insert
+    on storage_events
+    for each row
+execute procedure notify_storage_event();
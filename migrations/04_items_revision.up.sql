@@ -0,0 +1,2 @@
+alter table items
+    add column if not exists revision bigint not null default 0;
@@ -0,0 +1,3 @@
+drop index if exists items_expires_at_idx;
+alter table items
+    drop column if exists expires_at;
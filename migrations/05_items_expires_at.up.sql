@@ -0,0 +1,3 @@
+alter table items
+    add column if not exists expires_at timestamptz;
+create index if not exists items_expires_at_idx on items (expires_at) where expires_at is not null;
@@ -0,0 +1 @@
+-- sequence isn't moved back, revisions issued by it are in use
@@ -0,0 +1,4 @@
+-- revisions of items come from events sequence, it must be above revisions counted per record before
+select setval(pg_get_serial_sequence('storage_events', 'revision'), max(revision))
+from items
+having max(revision) > (select last_value from storage_events_revision_seq);
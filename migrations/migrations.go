@@ -0,0 +1,7 @@
+// Package migrations compiles migrations set into binary, so it doesn't depend on working directory
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
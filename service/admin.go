@@ -0,0 +1,53 @@
+package service
+
+import (
+	"context"
+
+	"github.com/kjushka/microservice-gen/internal/storage"
+	microservicepb2 "github.com/kjushka/microservice-gen/pkg/microservice"
+
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+type AdminHandler struct {
+	microservicepb2.AdminServer
+
+	invalidator storage.Invalidator
+	tracer      trace.Tracer
+}
+
+func NewAdminHandler(invalidator storage.Invalidator, tracer trace.Tracer) *AdminHandler {
+	return &AdminHandler{
+		invalidator: invalidator,
+		tracer:      tracer,
+	}
+}
+
+func (h *AdminHandler) InvalidateCache(ctx context.Context, req *microservicepb2.InvalidateCacheRequest) (*emptypb.Empty, error) {
+	ctx, span := h.tracer.Start(ctx, "admin invalidate cache")
+	defer span.End()
+
+	var err error
+	switch target := req.GetTarget().(type) {
+	case *microservicepb2.InvalidateCacheRequest_Tag:
+		if target.Tag == "" {
+			return nil, status.Error(codes.InvalidArgument, "tag must not be empty")
+		}
+		err = h.invalidator.InvalidateTag(ctx, target.Tag)
+	case *microservicepb2.InvalidateCacheRequest_Table:
+		if err = validateTable(target.Table); err != nil {
+			return nil, err
+		}
+		err = h.invalidator.InvalidateTable(ctx, target.Table)
+	default:
+		return nil, status.Error(codes.InvalidArgument, "tag or table must be set")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed invalidate cache: %v", err)
+	}
+
+	return &emptypb.Empty{}, nil
+}
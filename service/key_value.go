@@ -0,0 +1,301 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/kjushka/microservice-gen/internal/storage"
+	microservicepb2 "github.com/kjushka/microservice-gen/pkg/microservice"
+
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// tableNameRe protects storage from sql injection, table name goes to query as is
+var tableNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// internalTables are created by migrator and storage for themselves, they aren't available to callers
+var internalTables = map[string]struct{}{
+	"storage_events":    {},
+	"schema_migrations": {},
+	"resharding":        {},
+	"reencryption":      {},
+}
+
+// internalTablePrefix is prefix of postgres catalog, it is found by name without schema too
+const internalTablePrefix = "pg_"
+
+type KeyValueHandler struct {
+	microservicepb2.KeyValueServer
+
+	storage storage.Storage
+	// nil if storage backend doesn't support watch
+	watcher storage.Watcher
+	tracer  trace.Tracer
+}
+
+func NewKeyValueHandler(storage storage.Storage, watcher storage.Watcher, tracer trace.Tracer) *KeyValueHandler {
+	return &KeyValueHandler{
+		storage: storage,
+		watcher: watcher,
+		tracer:  tracer,
+	}
+}
+
+func (h *KeyValueHandler) Get(ctx context.Context, req *microservicepb2.GetRequest) (*microservicepb2.GetResponse, error) {
+	ctx, span := h.tracer.Start(ctx, "key value get")
+	defer span.End()
+
+	if err := validateKey(req.GetTable(), req.GetKey()); err != nil {
+		return nil, err
+	}
+
+	var (
+		data []byte
+		meta storage.Meta
+		err  error
+	)
+	if req.GetWithRevision() {
+		meta, err = h.storage.GetWithMeta(ctx, req.GetKey(), req.GetTable(), &data)
+	} else {
+		err = h.storage.Get(ctx, req.GetKey(), req.GetTable(), &data)
+	}
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	value, err := unmarshalValue(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &microservicepb2.GetResponse{Value: value, Revision: meta.Revision}, nil
+}
+
+func (h *KeyValueHandler) BatchGet(ctx context.Context, req *microservicepb2.BatchGetRequest) (*microservicepb2.BatchGetResponse, error) {
+	ctx, span := h.tracer.Start(ctx, "key value batch get")
+	defer span.End()
+
+	if err := validateTable(req.GetTable()); err != nil {
+		return nil, err
+	}
+	if len(req.GetKeys()) == 0 {
+		return &microservicepb2.BatchGetResponse{}, nil
+	}
+
+	data := make([][]byte, len(req.GetKeys()))
+	dest := make([]any, len(req.GetKeys()))
+	for i := range data {
+		dest[i] = &data[i]
+	}
+
+	err := h.storage.GetMany(ctx, req.GetKeys(), req.GetTable(), dest...)
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	items := make([]*microservicepb2.Item, 0, len(data))
+	for i, key := range req.GetKeys() {
+		value, err := unmarshalValue(data[i])
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, &microservicepb2.Item{Key: key, Value: value})
+	}
+
+	return &microservicepb2.BatchGetResponse{Items: items}, nil
+}
+
+func (h *KeyValueHandler) Put(ctx context.Context, req *microservicepb2.PutRequest) (*microservicepb2.PutResponse, error) {
+	ctx, span := h.tracer.Start(ctx, "key value put")
+	defer span.End()
+
+	if err := validateKey(req.GetTable(), req.GetKey()); err != nil {
+		return nil, err
+	}
+	if req.GetValue() == nil {
+		return nil, status.Error(codes.InvalidArgument, "value is required")
+	}
+	if req.GetExpectedRevision() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "expected revision must not be negative")
+	}
+
+	var opts []storage.SaveOption
+	if req.GetTtl() != nil {
+		if err := req.GetTtl().CheckValid(); err != nil || req.GetTtl().AsDuration() <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "ttl must be positive")
+		}
+		opts = append(opts, storage.WithTTL(req.GetTtl().AsDuration()))
+	}
+
+	data, err := proto.Marshal(req.GetValue())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed marshal value: %v", err)
+	}
+
+	if req.ExpectedRevision != nil {
+		revision, err := h.storage.SaveIf(ctx, req.GetKey(), req.GetTable(), data, req.GetExpectedRevision(), opts...)
+		if err != nil {
+			return nil, storageError(err)
+		}
+		return &microservicepb2.PutResponse{Revision: revision}, nil
+	}
+
+	err = h.storage.Save(ctx, req.GetKey(), data, req.GetTable(), opts...)
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	return &microservicepb2.PutResponse{}, nil
+}
+
+func (h *KeyValueHandler) Delete(ctx context.Context, req *microservicepb2.DeleteRequest) (*emptypb.Empty, error) {
+	ctx, span := h.tracer.Start(ctx, "key value delete")
+	defer span.End()
+
+	if err := validateKey(req.GetTable(), req.GetKey()); err != nil {
+		return nil, err
+	}
+
+	err := h.storage.Delete(ctx, req.GetKey(), req.GetTable())
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+func (h *KeyValueHandler) List(ctx context.Context, req *microservicepb2.ListRequest) (*microservicepb2.ListResponse, error) {
+	ctx, span := h.tracer.Start(ctx, "key value list")
+	defer span.End()
+
+	if err := validateTable(req.GetTable()); err != nil {
+		return nil, err
+	}
+	pageSize := int(req.GetPageSize())
+	switch {
+	case pageSize < 0:
+		return nil, status.Error(codes.InvalidArgument, "page size must not be negative")
+	case pageSize == 0:
+		pageSize = defaultPageSize
+	case pageSize > maxPageSize:
+		pageSize = maxPageSize
+	}
+
+	list, nextPageToken, err := h.storage.List(ctx, req.GetTable(), req.GetPrefix(), req.GetPageToken(), pageSize)
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	items := make([]*microservicepb2.Item, 0, len(list))
+	for _, item := range list {
+		var data []byte
+		err = item.Decode(&data)
+		if err != nil {
+			return nil, status.Errorf(codes.DataLoss, "failed decode stored value: %v", err)
+		}
+		value, err := unmarshalValue(data)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, &microservicepb2.Item{Key: item.Key, Value: value, Revision: item.Revision})
+	}
+
+	return &microservicepb2.ListResponse{Items: items, NextPageToken: nextPageToken}, nil
+}
+
+func (h *KeyValueHandler) Watch(req *microservicepb2.WatchRequest, stream microservicepb2.KeyValue_WatchServer) error {
+	ctx, span := h.tracer.Start(stream.Context(), "key value watch")
+	defer span.End()
+
+	if h.watcher == nil {
+		return status.Error(codes.Unimplemented, "watch is disabled")
+	}
+	if err := validateTable(req.GetTable()); err != nil {
+		return err
+	}
+	if req.GetStartRevision() < 0 {
+		return status.Error(codes.InvalidArgument, "start revision must not be negative")
+	}
+
+	err := h.watcher.Watch(ctx, req.GetTable(), req.GetPrefix(), req.GetStartRevision(), func(event storage.Event) error {
+		return stream.Send(&microservicepb2.WatchEvent{
+			Type:     eventTypes[event.Type],
+			Key:      event.Key,
+			Revision: event.Revision,
+		})
+	})
+	if ctx.Err() != nil {
+		return status.FromContextError(ctx.Err()).Err()
+	}
+	if err != nil {
+		return storageError(err)
+	}
+
+	return nil
+}
+
+var eventTypes = map[storage.EventType]microservicepb2.WatchEvent_Type{
+	storage.EventPut:    microservicepb2.WatchEvent_PUT,
+	storage.EventDelete: microservicepb2.WatchEvent_DELETE,
+}
+
+func validateTable(table string) error {
+	if !tableNameRe.MatchString(table) {
+		return status.Errorf(codes.InvalidArgument, "invalid table name '%s'", table)
+	}
+	// postgres folds names without quotes to lower case
+	name := strings.ToLower(table)
+	if _, ok := internalTables[name]; ok || strings.HasPrefix(name, internalTablePrefix) {
+		return status.Errorf(codes.InvalidArgument, "table '%s' is internal", table)
+	}
+	return nil
+}
+
+func validateKey(table, key string) error {
+	if err := validateTable(table); err != nil {
+		return err
+	}
+	if key == "" {
+		return status.Error(codes.InvalidArgument, "key is required")
+	}
+	return nil
+}
+
+func unmarshalValue(data []byte) (*microservicepb2.Value, error) {
+	value := &microservicepb2.Value{}
+	err := proto.Unmarshal(data, value)
+	if err != nil {
+		return nil, status.Errorf(codes.DataLoss, "failed unmarshal stored value: %v", err)
+	}
+	return value, nil
+}
+
+func storageError(err error) error {
+	if errors.Is(err, storage.ErrNotFound) {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	if errors.Is(err, storage.ErrInvalidPageToken) || errors.Is(err, storage.ErrInvalidLimit) {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if errors.Is(err, storage.ErrConflict) {
+		return status.Error(codes.Aborted, err.Error())
+	}
+	if errors.Is(err, storage.ErrCompacted) {
+		return status.Error(codes.OutOfRange, err.Error())
+	}
+	if errors.Is(err, storage.ErrUnsupported) {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return status.Errorf(codes.Internal, "storage failure: %v", err)
+}
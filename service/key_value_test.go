@@ -0,0 +1,148 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/kjushka/microservice-gen/internal/storage"
+	microservicepb2 "github.com/kjushka/microservice-gen/pkg/microservice"
+
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeStorage fails every call with err and counts calls, methods not used by tests panic
+type fakeStorage struct {
+	storage.Storage
+
+	err   error
+	calls int
+}
+
+func (s *fakeStorage) Get(context.Context, string, string, any) error {
+	s.calls++
+	return s.err
+}
+
+func (s *fakeStorage) SaveIf(context.Context, string, string, any, int64, ...storage.SaveOption) (int64, error) {
+	s.calls++
+	return 0, s.err
+}
+
+func (s *fakeStorage) List(context.Context, string, string, string, int) ([]storage.Item, string, error) {
+	s.calls++
+	return nil, "", s.err
+}
+
+type fakeWatcher struct {
+	err error
+}
+
+func (w *fakeWatcher) Watch(context.Context, string, string, int64, func(storage.Event) error) error {
+	return w.err
+}
+
+type fakeWatchServer struct {
+	microservicepb2.KeyValue_WatchServer
+}
+
+func (s *fakeWatchServer) Context() context.Context {
+	return context.Background()
+}
+
+func newTestHandler(err error) (*KeyValueHandler, *fakeStorage) {
+	s := &fakeStorage{err: err}
+	return NewKeyValueHandler(s, &fakeWatcher{err: err}, trace.NewNoopTracerProvider().Tracer("test")), s
+}
+
+func TestStorageErrorCodes(t *testing.T) {
+	ctx := context.Background()
+	get := func(h *KeyValueHandler) error {
+		_, err := h.Get(ctx, &microservicepb2.GetRequest{Table: "items", Key: "key"})
+		return err
+	}
+	putIf := func(h *KeyValueHandler) error {
+		revision := int64(1)
+		_, err := h.Put(ctx, &microservicepb2.PutRequest{
+			Table: "items", Key: "key", Value: &microservicepb2.Value{}, ExpectedRevision: &revision,
+		})
+		return err
+	}
+	list := func(h *KeyValueHandler) error {
+		_, err := h.List(ctx, &microservicepb2.ListRequest{Table: "items", PageToken: "token"})
+		return err
+	}
+	watch := func(h *KeyValueHandler) error {
+		return h.Watch(&microservicepb2.WatchRequest{Table: "items", StartRevision: 1}, &fakeWatchServer{})
+	}
+
+	tests := []struct {
+		name string
+		call func(h *KeyValueHandler) error
+		err  error
+		code codes.Code
+	}{
+		{name: "not found", call: get, err: fmt.Errorf("failed get: %w", storage.ErrNotFound), code: codes.NotFound},
+		{name: "missing keys", call: get, err: &storage.MissingKeysError{Table: "items", Keys: []string{"key"}}, code: codes.NotFound},
+		{name: "invalid page token", call: list, err: storage.ErrInvalidPageToken, code: codes.InvalidArgument},
+		{name: "invalid limit", call: list, err: storage.ErrInvalidLimit, code: codes.InvalidArgument},
+		{name: "conflict", call: putIf, err: &storage.ConflictError{Table: "items", Key: "key", ExpectedRevision: 1}, code: codes.Aborted},
+		{name: "compacted", call: watch, err: storage.ErrCompacted, code: codes.OutOfRange},
+		{name: "unsupported", call: putIf, err: storage.ErrUnsupported, code: codes.FailedPrecondition},
+		{name: "other", call: get, err: errors.New("connection refused"), code: codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newTestHandler(tt.err)
+			err := tt.call(h)
+			if code := status.Code(err); code != tt.code {
+				t.Fatalf("code is %v, want %v: %v", code, tt.code, err)
+			}
+		})
+	}
+}
+
+func TestValidateTable(t *testing.T) {
+	tests := []struct {
+		table string
+		valid bool
+	}{
+		{table: "items", valid: true},
+		{table: "user_events", valid: true},
+		{table: "", valid: false},
+		{table: "items; drop table items", valid: false},
+		{table: "public.items", valid: false},
+		{table: "storage_events", valid: false},
+		{table: "Storage_Events", valid: false},
+		{table: "schema_migrations", valid: false},
+		{table: "resharding", valid: false},
+		{table: "reencryption", valid: false},
+		{table: "pg_class", valid: false},
+		{table: "PG_authid", valid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.table, func(t *testing.T) {
+			err := validateTable(tt.table)
+			if (err == nil) != tt.valid {
+				t.Fatalf("validate error is %v, want valid %v", err, tt.valid)
+			}
+			if err != nil && status.Code(err) != codes.InvalidArgument {
+				t.Fatalf("code is %v, want %v", status.Code(err), codes.InvalidArgument)
+			}
+		})
+	}
+
+	t.Run("internal table doesn't reach storage", func(t *testing.T) {
+		h, s := newTestHandler(nil)
+		_, err := h.Get(context.Background(), &microservicepb2.GetRequest{Table: "storage_events", Key: "1"})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("code is %v, want %v", status.Code(err), codes.InvalidArgument)
+		}
+		if s.calls != 0 {
+			t.Fatalf("storage is called %d times", s.calls)
+		}
+	})
+}